@@ -5,11 +5,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/device-management-toolkit/mps-router/internal/db"
 	"github.com/device-management-toolkit/mps-router/internal/proxy"
@@ -21,57 +30,103 @@ func main() {
 		os.Args[1:],
 		os.Getenv,
 		startServerReal,
-		func(s string) db.Manager { return db.NewMongoManager(s) },
-		func(s string) db.Manager { return db.NewPostgresManager(s) },
+		db.New,
 	)
 	os.Exit(code)
 }
 
-func isMongoConnectionString(connectionString string) bool {
-	return strings.HasPrefix(connectionString, "mongodb")
+// healthTimeout bounds the database check of the -health mode
+const healthTimeout = 5 * time.Second
+
+// stdout receives the report of the -health mode, replaced in tests
+var stdout io.Writer = os.Stdout
+
+// defaultDrainTimeout is how long active connections may take to finish after
+// a termination signal before they are closed
+const defaultDrainTimeout = 30 * time.Second
+
+// serverConfig holds the proxy settings resolved by run
+type serverConfig struct {
+	// TCP address to listen on
+	addr string
+	// TCP address of the default MPS instance
+	target string
+	// How long to wait for active connections on shutdown
+	drainTimeout time.Duration
+	// How long to wait for the database to find a device's MPS instance
+	lookupTimeout time.Duration
+	// Maximum number of client connections served at once, zero for no limit
+	maxConns int
+	// Maximum bytes buffered while waiting for a request head
+	maxHeaderBytes int
+	// How long a client has to send a request head, which is also how long a
+	// kept-alive connection may stay idle, zero for no deadline
+	headerTimeout time.Duration
+	// Whether requests for devices unknown to the database are rejected
+	strictRouting bool
+	// Template applied to MPS instances from the database, nil for none
+	destination *template.Template
+	// Addresses of aliased MPS instances, nil for none
+	aliases *proxy.Aliases
+	// MPS instances sharing requests for the default target, nil for none
+	pool *proxy.Pool
+	// Health checker for the default targets, nil when disabled
+	health *proxy.HealthChecker
 }
 
 // run is the testable entry point for the application. It parses args/env,
-// selects DB implementation, and starts the proxy server. It returns a process
+// selects DB implementation, and starts the proxy server. SIGTERM and SIGINT
+// stop the server once active connections have drained. It returns a process
 // exit code (0=success, non-zero=failure) instead of exiting directly.
 func run(
 	args []string,
 	getenv func(string) string,
-	startServer func(db.Manager, string, string) error,
-	newMongo func(string) db.Manager,
-	newPostgres func(string) db.Manager,
-	// return
+	startServer func(context.Context, db.Manager, serverConfig) error,
+	newManager func(string) (db.Manager, error),
 ) int {
 	fs := flag.NewFlagSet("mps-router", flag.ContinueOnError)
 	// Suppress default output in tests; errors will be handled via return code.
 	fs.SetOutput(io.Discard)
 	health := fs.Bool("health", false, "check health of service")
+	strict := fs.Bool("strict", false, "reject requests for devices with no MPS instance in the database")
 	if err := fs.Parse(args); err != nil {
 		log.Println("failed to parse flags:", err)
 		return 1
 	}
 
 	connectionString := getenv("MPS_CONNECTION_STRING")
-	if connectionString == "" {
+	connectionStrings := getenv("MPS_CONNECTION_STRINGS")
+	if connectionString == "" && connectionStrings == "" {
 		// Preserve original message text to avoid surprising users/logs.
 		log.Println("MPS_CONNECTION_STRING env is not set,default is mps")
 		return 1
 	}
 
-	// Select DB implementation based on connection string.
+	// Select DB implementation based on connection string, or chain several.
 	var dbImplementation db.Manager
-	if isMongoConnectionString(connectionString) {
-		dbImplementation = newMongo(connectionString)
+	var err error
+	if connectionStrings != "" {
+		dbImplementation, err = newChain(getenv, connectionStrings, newManager)
+		if err != nil {
+			log.Println("invalid MPS_CONNECTION_STRINGS:", err)
+			return 1
+		}
 	} else {
-		dbImplementation = newPostgres(connectionString)
+		dbImplementation, err = newManager(connectionString)
+		if err != nil {
+			log.Println("invalid MPS_CONNECTION_STRING:", err)
+			return 1
+		}
 	}
+	defer func() {
+		if err := db.Close(dbImplementation); err != nil {
+			log.Println("failed to close database:", err)
+		}
+	}()
 
 	// Health check mode short-circuits server startup.
 	if *health {
-		if dbImplementation.Health() {
-			return 0
-		}
-		return 1
+		return checkHealth(dbImplementation)
 	}
 
 	// Resolve envs with defaults.
@@ -91,22 +146,279 @@ func run(
 		mpsHost = "mps"
 	}
 
-	addr := ":" + routerPort
-	target := mpsHost + ":" + mpsPort
-	if err := startServer(dbImplementation, addr, target); err != nil {
+	drainTimeout, ok := durationEnv(getenv, "MPS_DRAIN_TIMEOUT", defaultDrainTimeout)
+	if !ok {
+		return 1
+	}
+	lookupTimeout, ok := durationEnv(getenv, "MPS_LOOKUP_TIMEOUT", proxy.DefaultLookupTimeout)
+	if !ok {
+		return 1
+	}
+	maxConns, ok := intEnv(getenv, "MPS_MAX_CONNECTIONS", 0)
+	if !ok {
+		return 1
+	}
+	maxHeaderBytes, ok := intEnv(getenv, "MPS_MAX_HEADER_BYTES", proxy.DefaultMaxHeaderBytes)
+	if !ok {
+		return 1
+	}
+	headerTimeout, ok := durationEnv(getenv, "MPS_HEADER_TIMEOUT", proxy.DefaultHeaderTimeout)
+	if !ok {
+		return 1
+	}
+
+	// Collapse concurrent lookups of a device, then cache routes in front of
+	// whichever database was selected.
+	dbImplementation = db.NewCoalescingManager(dbImplementation)
+	cacheSize, ok := intEnv(getenv, "MPS_CACHE_SIZE", db.DefaultCacheSize)
+	if !ok {
+		return 1
+	}
+	cacheTTL, ok := durationEnv(getenv, "MPS_CACHE_TTL", db.DefaultCacheTTL)
+	if !ok {
+		return 1
+	}
+	negativeCacheTTL, ok := durationEnv(getenv, "MPS_CACHE_NEGATIVE_TTL", db.DefaultNegativeCacheTTL)
+	if !ok {
+		return 1
+	}
+	if cacheSize > 0 && cacheTTL > 0 {
+		dbImplementation = db.NewCachingManager(dbImplementation, cacheSize, cacheTTL, negativeCacheTTL)
+	}
+
+	strictRouting := *strict
+	if value := getenv("MPS_STRICT_ROUTING"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Println("invalid MPS_STRICT_ROUTING:", value)
+			return 1
+		}
+		strictRouting = strictRouting || b
+	}
+
+	var destination *template.Template
+	if value := getenv("MPS_DESTINATION_TEMPLATE"); value != "" {
+		tmpl, err := proxy.ParseDestinationTemplate(value)
+		if err != nil {
+			log.Println("invalid MPS_DESTINATION_TEMPLATE:", err)
+			return 1
+		}
+		destination = tmpl
+	}
+
+	var aliases *proxy.Aliases
+	if path := getenv("MPS_ALIAS_FILE"); path != "" {
+		a, err := proxy.LoadAliases(path)
+		if err != nil {
+			log.Println("invalid MPS_ALIAS_FILE:", err)
+			return 1
+		}
+		aliases = a
+	}
+
+	pool, err := loadPool(getenv, mpsHost+":"+mpsPort)
+	if err != nil {
+		log.Println("invalid default target pool:", err)
+		return 1
+	}
+
+	checkInterval, ok := durationEnv(getenv, "MPS_UPSTREAM_CHECK_INTERVAL", 0)
+	if !ok {
+		return 1
+	}
+	var checker *proxy.HealthChecker
+	if checkInterval > 0 {
+		targets := []string{mpsHost + ":" + mpsPort}
+		if pool != nil {
+			targets = pool.Addrs()
+		}
+		checker = proxy.NewHealthChecker(targets...)
+		checker.Interval = checkInterval
+		checker.Path = getenv("MPS_UPSTREAM_CHECK_PATH")
+	}
+
+	cfg := serverConfig{
+		addr:           ":" + routerPort,
+		target:         mpsHost + ":" + mpsPort,
+		drainTimeout:   drainTimeout,
+		lookupTimeout:  lookupTimeout,
+		maxConns:       maxConns,
+		maxHeaderBytes: maxHeaderBytes,
+		headerTimeout:  headerTimeout,
+		strictRouting:  strictRouting,
+		destination:    destination,
+		aliases:        aliases,
+		pool:           pool,
+		health:         checker,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := startServer(ctx, dbImplementation, cfg); err != nil {
 		log.Println("ListenAndServe:", err)
 		return 1
 	}
 	return 0
 }
 
-// startServerReal constructs the proxy server and starts it. This is split out
-// to allow tests to inject a fake to avoid binding a real port.
-func startServerReal(m db.Manager, addr, target string) error {
-	p := proxy.NewServer(m, addr, target)
+// checkHealth prints the database health report as JSON and returns the exit
+// code of the -health mode, 0 if the database is reachable
+func checkHealth(m db.Manager) int {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	report := m.Health(ctx)
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Println("failed to write health report:", err)
+	}
+	if report.Reachable {
+		return 0
+	}
+	return 1
+}
+
+// newChain returns a manager consulting the databases of connectionStrings,
+// separated by "|", in the order given. MPS_CHAIN_MODE chooses whether they
+// are asked in order ("sequential", the default) or all at once ("parallel"),
+// and MPS_CHAIN_HEALTH whether all of them or any must be reachable.
+func newChain(getenv func(string) string, connectionStrings string, newManager func(string) (db.Manager, error)) (db.Manager, error) {
+	parallel := false
+	switch mode := getenv("MPS_CHAIN_MODE"); mode {
+	case "", "sequential":
+	case "parallel":
+		parallel = true
+	default:
+		return nil, fmt.Errorf("unknown MPS_CHAIN_MODE %q, expected sequential or parallel", mode)
+	}
+	policy := db.ChainHealthAll
+	if value := getenv("MPS_CHAIN_HEALTH"); value != "" {
+		p, err := db.ParseChainHealthPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("MPS_CHAIN_HEALTH: %w", err)
+		}
+		policy = p
+	}
+
+	var managers []db.Manager
+	for connectionString := range strings.SplitSeq(connectionStrings, "|") {
+		connectionString = strings.TrimSpace(connectionString)
+		if connectionString == "" {
+			continue
+		}
+		m, err := newManager(connectionString)
+		if err != nil {
+			for _, m := range managers {
+				_ = db.Close(m)
+			}
+			return nil, err
+		}
+		managers = append(managers, m)
+	}
+	if len(managers) == 0 {
+		return nil, errors.New("no connection strings")
+	}
+	return db.NewChainManager(managers, parallel, policy), nil
+}
+
+// durationEnv returns the non-negative duration in the environment variable
+// key, or def when it is not set. It logs and reports false when the value is
+// invalid.
+func durationEnv(getenv func(string) string, key string, def time.Duration) (time.Duration, bool) {
+	value := getenv(key)
+	if value == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s: %s", key, value)
+		return 0, false
+	}
+	return d, true
+}
+
+// intEnv returns the non-negative integer in the environment variable key, or
+// def when it is not set. It logs and reports false when the value is invalid.
+func intEnv(getenv func(string) string, key string, def int) (int, bool) {
+	value := getenv(key)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s: %s", key, value)
+		return 0, false
+	}
+	return n, true
+}
+
+// loadPool builds the pool of default targets from MPS_TARGETS_FILE, or from
+// the comma separated MPS_TARGETS and MPS_TARGET_STRATEGY. It returns nil when
+// neither is set, leaving target as the only default.
+func loadPool(getenv func(string) string, target string) (*proxy.Pool, error) {
+	if path := getenv("MPS_TARGETS_FILE"); path != "" {
+		return proxy.LoadPool(path, target)
+	}
+	if list := getenv("MPS_TARGETS"); list != "" {
+		return proxy.ParsePool(proxy.Strategy(getenv("MPS_TARGET_STRATEGY")), list, target)
+	}
+	return nil, nil
+}
+
+// startServerReal constructs the proxy server and runs it until ctx is done,
+// then shuts it down gracefully. Aliases are reloaded on SIGHUP or when their
+// file changes, and default targets and alias addresses are health checked
+// when configured. This is split out to allow tests to inject a fake to avoid
+// binding a real port.
+func startServerReal(ctx context.Context, m db.Manager, cfg serverConfig) error {
+	p := proxy.NewServer(m, cfg.addr, cfg.target)
+	p.LookupTimeout = cfg.lookupTimeout
+	p.MaxConns = cfg.maxConns
+	p.MaxHeaderBytes = cfg.maxHeaderBytes
+	p.HeaderTimeout = cfg.headerTimeout
+	p.StrictRouting = cfg.strictRouting
+	p.DestinationTemplate = cfg.destination
+	p.Aliases = cfg.aliases
+	p.Pool = cfg.pool
+	p.Health = cfg.health
+	if cfg.aliases != nil {
+		if cfg.health != nil {
+			p.CheckAliases()
+			cfg.aliases.OnReload(p.CheckAliases)
+		}
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go cfg.aliases.Watch(watchCtx, proxy.DefaultAliasPollInterval, hup)
+	}
+	if cfg.health != nil {
+		checkCtx, stopChecking := context.WithCancel(ctx)
+		defer stopChecking()
+		go cfg.health.Run(checkCtx)
+	}
 	log.Println("Proxying from " + p.Addr + " to :" + p.Target)
-	if err := p.ListenAndServe(); err != nil {
+	if p.Pool != nil {
+		log.Println("Requests for the default target are shared by", strings.Join(p.Pool.Addrs(), ", "))
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, draining connections for up to", cfg.drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.drainTimeout)
+	defer cancel()
+	if err := p.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-served; !errors.Is(err, proxy.ErrServerClosed) {
 		return err
 	}
+	log.Println("All connections drained")
 	return nil
 }
@@ -1,27 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/device-management-toolkit/mps-router/internal/db"
+	"github.com/device-management-toolkit/mps-router/internal/proxy"
 	itest "github.com/device-management-toolkit/mps-router/internal/test"
 )
 
 // fakeManager implements db.Manager minimal surface via internal/test mocks
-// to observe Health() and Query() behaviors.
+// to observe Health(ctx) and Query() behaviors.
 
 type fakeServerStart struct {
-	called bool
-	addr   string
-	target string
-	err    error
+	called  bool
+	manager db.Manager
+	addr    string
+	target  string
+	// drain timeout passed to the server
+	drainTimeout time.Duration
+	// lookup timeout and connection limit passed to the server
+	lookupTimeout time.Duration
+	maxConns      int
+	// request head limits passed to the server
+	maxHeaderBytes int
+	headerTimeout  time.Duration
+	strictRouting  bool
+	destination    *template.Template
+	aliases        *proxy.Aliases
+	pool           *proxy.Pool
+	health         *proxy.HealthChecker
+	err            error
 }
 
-func (f *fakeServerStart) start(_ db.Manager, addr, target string) error {
+func (f *fakeServerStart) start(_ context.Context, m db.Manager, cfg serverConfig) error {
 	f.called = true
-	f.addr = addr
-	f.target = target
+	f.manager = m
+	f.addr = cfg.addr
+	f.target = cfg.target
+	f.drainTimeout = cfg.drainTimeout
+	f.lookupTimeout = cfg.lookupTimeout
+	f.maxConns = cfg.maxConns
+	f.maxHeaderBytes = cfg.maxHeaderBytes
+	f.headerTimeout = cfg.headerTimeout
+	f.strictRouting = cfg.strictRouting
+	f.destination = cfg.destination
+	f.aliases = cfg.aliases
+	f.pool = cfg.pool
+	f.health = cfg.health
 	return f.err
 }
 
@@ -31,38 +65,30 @@ type (
 	pgMgr    = itest.MockSQLDBManager
 )
 
-func TestIsMongoConnectionString(t *testing.T) {
-	cases := []struct {
-		input string
-		want  bool
-	}{
-		{"mongodb://localhost:27017", true},
-		{"mongodb+srv://atlas.test", true},
-		{"postgres://localhost:5432", false},
-	}
-
-	for _, c := range cases {
-		got := isMongoConnectionString(c.input)
-		if got != c.want {
-			t.Errorf("isMongoConnectionString(%q) = %v, want %v", c.input, got, c.want)
-		}
-	}
-}
-
 func TestRun_RequiresConnectionString(t *testing.T) {
 	code := run(
 		nil,
 		func(s string) string { return "" },
-		func(_ db.Manager, _, _ string) error { return nil },
-		func(s string) db.Manager { return &mongoMgr{} },
-		func(s string) db.Manager { return &pgMgr{} },
+		func(context.Context, db.Manager, serverConfig) error { return nil },
+		func(s string) (db.Manager, error) { return &pgMgr{}, nil },
 	)
 	if code == 0 {
 		t.Fatalf("expected non-zero exit code when MPS_CONNECTION_STRING missing")
 	}
 }
 
+// captureStdout collects what run prints until the end of the test
+func captureStdout(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := stdout
+	stdout = &buf
+	t.Cleanup(func() { stdout = prev })
+	return &buf
+}
+
 func TestRun_HealthSuccessAndFailure(t *testing.T) {
+	out := captureStdout(t)
 	// success path
 	getenv := func(key string) string {
 		switch key {
@@ -76,9 +102,8 @@ func TestRun_HealthSuccessAndFailure(t *testing.T) {
 	code := run(
 		[]string{"-health"},
 		getenv,
-		func(m db.Manager, a, tg string) error { return start.start(m, a, tg) },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
+		start.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
 	)
 	if code != 0 {
 		t.Fatalf("health success expected 0, got %d", code)
@@ -91,13 +116,51 @@ func TestRun_HealthSuccessAndFailure(t *testing.T) {
 	code = run(
 		[]string{"-health"},
 		getenv,
-		func(m db.Manager, a, tg string) error { return start.start(m, a, tg) },
-		func(s string) db.Manager { return &pgMgr{HealthResult: false} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: false} },
+		start.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: false}, nil },
 	)
 	if code == 0 {
 		t.Fatalf("health failure expected non-zero, got %d", code)
 	}
+
+	// both reports are printed as JSON
+	dec := json.NewDecoder(out)
+	for _, want := range []bool{true, false} {
+		var report struct {
+			Backend   string `json:"backend"`
+			Reachable bool   `json:"reachable"`
+			Latency   string `json:"latency"`
+		}
+		if err := dec.Decode(&report); err != nil {
+			t.Fatalf("failed to decode health report: %v", err)
+		}
+		if report.Reachable != want || report.Backend != "mock" || report.Latency == "" {
+			t.Fatalf("unexpected health report %+v", report)
+		}
+	}
+}
+
+func TestRun_ClosesDatabase(t *testing.T) {
+	getenv := func(key string) string {
+		if key == "MPS_CONNECTION_STRING" {
+			return "mongodb://test"
+		}
+		return ""
+	}
+	captureStdout(t)
+	for _, args := range [][]string{nil, {"-health"}} {
+		manager := &mongoMgr{HealthResult: true}
+		start := &fakeServerStart{}
+		code := run(args, getenv, start.start,
+			func(s string) (db.Manager, error) { return manager, nil },
+		)
+		if code != 0 {
+			t.Fatalf("run(%v) expected 0, got %d", args, code)
+		}
+		if !manager.Closed {
+			t.Fatalf("run(%v) should close the database on exit", args)
+		}
+	}
 }
 
 func TestRun_EnvDefaultsAndOverrides(t *testing.T) {
@@ -112,15 +175,20 @@ func TestRun_EnvDefaultsAndOverrides(t *testing.T) {
 	code := run(
 		nil,
 		getenvDefaults,
-		func(m db.Manager, a, tg string) error { return server.start(m, a, tg) },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
 	)
 	if code != 0 {
 		t.Fatalf("expected success, got %d", code)
 	}
-	if !server.called || server.addr != ":8003" || server.target != "mps:3000" {
-		t.Fatalf("defaults not applied: got addr=%q target=%q", server.addr, server.target)
+	if !server.called || server.addr != ":8003" || server.target != "mps:3000" || server.drainTimeout != defaultDrainTimeout {
+		t.Fatalf("defaults not applied: got addr=%q target=%q drain=%v", server.addr, server.target, server.drainTimeout)
+	}
+	if server.maxHeaderBytes != proxy.DefaultMaxHeaderBytes || server.headerTimeout != proxy.DefaultHeaderTimeout {
+		t.Fatalf("defaults not applied: maxHeaderBytes=%d headerTimeout=%v", server.maxHeaderBytes, server.headerTimeout)
+	}
+	if server.lookupTimeout != proxy.DefaultLookupTimeout || server.maxConns != 0 {
+		t.Fatalf("defaults not applied: got lookup=%v maxConns=%d", server.lookupTimeout, server.maxConns)
 	}
 
 	// Overrides
@@ -134,6 +202,16 @@ func TestRun_EnvDefaultsAndOverrides(t *testing.T) {
 			return "example.local"
 		case "MPS_PORT":
 			return "1234"
+		case "MPS_DRAIN_TIMEOUT":
+			return "5s"
+		case "MPS_LOOKUP_TIMEOUT":
+			return "2s"
+		case "MPS_MAX_CONNECTIONS":
+			return "100"
+		case "MPS_MAX_HEADER_BYTES":
+			return "4096"
+		case "MPS_HEADER_TIMEOUT":
+			return "3s"
 		default:
 			return ""
 		}
@@ -142,43 +220,115 @@ func TestRun_EnvDefaultsAndOverrides(t *testing.T) {
 	code = run(
 		nil,
 		getenvOverrides,
-		func(m db.Manager, a, tg string) error { return server2.start(m, a, tg) },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
+		server2.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
 	)
 	if code != 0 {
 		t.Fatalf("expected success with overrides, got %d", code)
 	}
-	if server2.addr != ":9000" || server2.target != "example.local:1234" {
-		t.Fatalf("overrides not applied: addr=%q target=%q", server2.addr, server2.target)
+	if server2.addr != ":9000" || server2.target != "example.local:1234" || server2.drainTimeout != 5*time.Second {
+		t.Fatalf("overrides not applied: addr=%q target=%q drain=%v", server2.addr, server2.target, server2.drainTimeout)
+	}
+	if server2.lookupTimeout != 2*time.Second || server2.maxConns != 100 {
+		t.Fatalf("overrides not applied: lookup=%v maxConns=%d", server2.lookupTimeout, server2.maxConns)
+	}
+	if server2.maxHeaderBytes != 4096 || server2.headerTimeout != 3*time.Second {
+		t.Fatalf("overrides not applied: maxHeaderBytes=%d headerTimeout=%v", server2.maxHeaderBytes, server2.headerTimeout)
 	}
 }
 
 func TestRun_DBSelection(t *testing.T) {
-	// capture which constructor was called
-	var used []string
 	getenv := func(k string) string {
 		if k == "MPS_CONNECTION_STRING" {
 			return "mongodb://atlas"
 		}
 		return ""
 	}
-	// track calls
-	newMongo := func(s string) db.Manager {
-		used = append(used, "mongo")
-		return &mongoMgr{HealthResult: true}
-	}
-	newPg := func(s string) db.Manager {
-		used = append(used, "pg")
-		return &pgMgr{HealthResult: true}
+	// the connection string is handed to the constructor
+	var used []string
+	newManager := func(s string) (db.Manager, error) {
+		used = append(used, s)
+		return &mongoMgr{HealthResult: true}, nil
 	}
 	server := &fakeServerStart{}
-	code := run(nil, getenv, func(m db.Manager, a, tg string) error { return server.start(m, a, tg) }, newMongo, newPg)
+	code := run(nil, getenv, server.start, newManager)
 	if code != 0 {
 		t.Fatalf("expected success, got %d", code)
 	}
-	if len(used) != 1 || used[0] != "mongo" {
-		t.Fatalf("expected mongo constructor used, got %v", used)
+	if !slices.Equal(used, []string{"mongodb://atlas"}) {
+		t.Fatalf("expected constructor called with the connection string, got %v", used)
+	}
+
+	// a connection string the constructor rejects stops startup
+	server = &fakeServerStart{}
+	code = run(nil, getenv, server.start, func(s string) (db.Manager, error) {
+		return nil, errors.New("bad connection string")
+	})
+	if code == 0 || server.called {
+		t.Fatalf("expected failure without starting the server, got %d", code)
+	}
+}
+
+func TestRun_ConnectionStrings(t *testing.T) {
+	env := map[string]string{
+		"MPS_CONNECTION_STRING":  "postgres://ignored",
+		"MPS_CONNECTION_STRINGS": "mongodb://old | postgres://new|",
+		"MPS_CHAIN_MODE":         "parallel",
+		"MPS_CHAIN_HEALTH":       "any",
+	}
+	getenv := func(k string) string { return env[k] }
+	var used []string
+	var created []*mongoMgr
+	newManager := func(s string) (db.Manager, error) {
+		used = append(used, s)
+		if s == "postgres://broken" {
+			return nil, errors.New("bad connection string")
+		}
+		m := &mongoMgr{HealthResult: true}
+		created = append(created, m)
+		return m, nil
+	}
+
+	server := &fakeServerStart{}
+	if code := run(nil, getenv, server.start, newManager); code != 0 {
+		t.Fatalf("expected success, got %d", code)
+	}
+	if !slices.Equal(used, []string{"mongodb://old", "postgres://new"}) {
+		t.Fatalf("expected a manager per connection string, got %v", used)
+	}
+	// the chain sits behind the coalescing and caching managers; its health
+	// shows through them
+	report := server.manager.Health(context.Background())
+	if report.Backend != "chain" || len(report.Members) != 2 {
+		t.Fatalf("expected a chain of two managers, got %+v", report)
+	}
+	for _, m := range created {
+		if !m.Closed {
+			t.Fatalf("expected every chained manager to be closed on exit")
+		}
+	}
+
+	invalid := []map[string]string{
+		{"MPS_CHAIN_MODE": "random"},
+		{"MPS_CHAIN_HEALTH": "most"},
+		{"MPS_CONNECTION_STRINGS": " | "},
+		{"MPS_CONNECTION_STRINGS": "mongodb://old|postgres://broken"},
+	}
+	for _, overrides := range invalid {
+		env = map[string]string{"MPS_CONNECTION_STRINGS": "mongodb://old|postgres://new"}
+		for k, v := range overrides {
+			env[k] = v
+		}
+		created = nil
+		server = &fakeServerStart{}
+		if code := run(nil, getenv, server.start, newManager); code == 0 || server.called {
+			t.Fatalf("expected failure without starting the server for %v, got %d", overrides, code)
+		}
+		for _, m := range created {
+			if !m.Closed {
+				t.Fatalf("expected managers created before a failure to be closed for %v", overrides)
+			}
+		}
 	}
 }
 
@@ -194,9 +344,8 @@ func TestRun_ServerErrorPropagates(t *testing.T) {
 	code := run(
 		nil,
 		getenv,
-		func(m db.Manager, a, tg string) error { return server.start(m, a, tg) },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
 	)
 	if code == 0 {
 		t.Fatalf("expected non-zero when server returns error")
@@ -208,18 +357,379 @@ func TestRun_FlagParseError(t *testing.T) {
 	code := run(
 		[]string{"-health=maybe"}, // invalid bool value triggers parse error
 		getenv,
-		func(m db.Manager, a, tg string) error { return nil },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
-		func(s string) db.Manager { return &pgMgr{HealthResult: true} },
+		func(context.Context, db.Manager, serverConfig) error { return nil },
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
 	)
 	if code == 0 {
 		t.Fatalf("expected non-zero exit on flag parse error")
 	}
 }
 
+func TestRun_InvalidDrainTimeout(t *testing.T) {
+	getenv := func(k string) string {
+		switch k {
+		case "MPS_CONNECTION_STRING":
+			return "postgres://test"
+		case "MPS_DRAIN_TIMEOUT":
+			return "soon"
+		default:
+			return ""
+		}
+	}
+	server := &fakeServerStart{}
+	code := run(
+		nil,
+		getenv,
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+	)
+	if code == 0 || server.called {
+		t.Fatalf("expected non-zero exit without starting the server, got %d", code)
+	}
+}
+
+func TestRun_InvalidServerLimits(t *testing.T) {
+	cases := map[string]string{
+		"MPS_LOOKUP_TIMEOUT":   "later",
+		"MPS_MAX_CONNECTIONS":  "-1",
+		"MPS_MAX_HEADER_BYTES": "64k",
+		"MPS_HEADER_TIMEOUT":   "-1s",
+	}
+	for key, value := range cases {
+		getenv := func(k string) string {
+			switch k {
+			case "MPS_CONNECTION_STRING":
+				return "postgres://test"
+			case key:
+				return value
+			default:
+				return ""
+			}
+		}
+		server := &fakeServerStart{}
+		code := run(
+			nil,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if code == 0 || server.called {
+			t.Fatalf("expected non-zero exit for %s=%q, got %d", key, value, code)
+		}
+	}
+}
+
+func TestRun_StrictRouting(t *testing.T) {
+	cases := []struct {
+		args []string
+		env  string
+		want bool
+	}{
+		{nil, "", false},
+		{[]string{"-strict"}, "", true},
+		{nil, "true", true},
+		{[]string{"-strict"}, "false", true},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string {
+			switch k {
+			case "MPS_CONNECTION_STRING":
+				return "postgres://test"
+			case "MPS_STRICT_ROUTING":
+				return c.env
+			default:
+				return ""
+			}
+		}
+		server := &fakeServerStart{}
+		code := run(
+			c.args,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if code != 0 || server.strictRouting != c.want {
+			t.Fatalf("args=%v env=%q: expected strict=%v, got code=%d strict=%v", c.args, c.env, c.want, code, server.strictRouting)
+		}
+	}
+
+	getenv := func(k string) string {
+		switch k {
+		case "MPS_CONNECTION_STRING":
+			return "postgres://test"
+		case "MPS_STRICT_ROUTING":
+			return "sometimes"
+		default:
+			return ""
+		}
+	}
+	server := &fakeServerStart{}
+	code := run(
+		nil,
+		getenv,
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+	)
+	if code == 0 || server.called {
+		t.Fatalf("expected non-zero exit for invalid MPS_STRICT_ROUTING, got %d", code)
+	}
+}
+
+func TestRun_DestinationTemplate(t *testing.T) {
+	cases := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"{{.Instance}}.mps-headless.default.svc.cluster.local:{{.DefaultPort}}", false},
+		{"{{.Instance", true},
+		{"{{.Namespace}}", true},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string {
+			switch k {
+			case "MPS_CONNECTION_STRING":
+				return "postgres://test"
+			case "MPS_DESTINATION_TEMPLATE":
+				return c.value
+			default:
+				return ""
+			}
+		}
+		server := &fakeServerStart{}
+		code := run(
+			nil,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if c.wantErr {
+			if code == 0 || server.called {
+				t.Fatalf("expected non-zero exit for template %q, got %d", c.value, code)
+			}
+			continue
+		}
+		if code != 0 || server.destination == nil {
+			t.Fatalf("expected template %q to be passed to the server, got code=%d", c.value, code)
+		}
+	}
+}
+
+func TestRun_AliasFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "aliases.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(valid, []byte("mps-0: 10.0.0.5:3000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invalid, []byte("mps-0: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path    string
+		wantErr bool
+	}{
+		{valid, false},
+		{invalid, true},
+		{filepath.Join(dir, "missing.yaml"), true},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string {
+			switch k {
+			case "MPS_CONNECTION_STRING":
+				return "postgres://test"
+			case "MPS_ALIAS_FILE":
+				return c.path
+			default:
+				return ""
+			}
+		}
+		server := &fakeServerStart{}
+		code := run(
+			nil,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if c.wantErr {
+			if code == 0 || server.called {
+				t.Fatalf("expected non-zero exit for alias file %q, got %d", c.path, code)
+			}
+			continue
+		}
+		if code != 0 || server.aliases == nil {
+			t.Fatalf("expected aliases from %q to be passed to the server, got code=%d", c.path, code)
+		}
+	}
+}
+
+func TestRun_TargetPool(t *testing.T) {
+	dir := t.TempDir()
+	poolFile := filepath.Join(dir, "pool.yaml")
+	if err := os.WriteFile(poolFile, []byte("strategy: least-connections\ntargets:\n  - address: mps-2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{"None", map[string]string{}, nil, false},
+		{"List", map[string]string{"MPS_TARGETS": "mps-0,mps-1:3001=2", "MPS_TARGET_STRATEGY": "weighted"}, []string{"mps-0:3000", "mps-1:3001"}, false},
+		{"File", map[string]string{"MPS_TARGETS_FILE": poolFile, "MPS_TARGETS": "ignored"}, []string{"mps-2:3000"}, false},
+		{"Unknown Strategy", map[string]string{"MPS_TARGETS": "mps-0", "MPS_TARGET_STRATEGY": "random"}, nil, true},
+		{"Missing File", map[string]string{"MPS_TARGETS_FILE": filepath.Join(dir, "missing.yaml")}, nil, true},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string {
+			if k == "MPS_CONNECTION_STRING" {
+				return "postgres://test"
+			}
+			return c.env[k]
+		}
+		server := &fakeServerStart{}
+		code := run(
+			nil,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if c.wantErr {
+			if code == 0 || server.called {
+				t.Fatalf("%s: expected non-zero exit, got %d", c.name, code)
+			}
+			continue
+		}
+		if code != 0 {
+			t.Fatalf("%s: expected success, got %d", c.name, code)
+		}
+		if c.want == nil {
+			if server.pool != nil {
+				t.Fatalf("%s: expected no pool", c.name)
+			}
+			continue
+		}
+		if server.pool == nil || !slices.Equal(server.pool.Addrs(), c.want) {
+			t.Fatalf("%s: expected pool %v, got %v", c.name, c.want, server.pool)
+		}
+	}
+}
+
+func TestRun_UpstreamHealthChecks(t *testing.T) {
+	env := map[string]string{
+		"MPS_CONNECTION_STRING":       "postgres://test",
+		"MPS_TARGETS":                 "mps-0,mps-1",
+		"MPS_UPSTREAM_CHECK_INTERVAL": "2s",
+		"MPS_UPSTREAM_CHECK_PATH":     "/api/v1/health",
+	}
+	server := &fakeServerStart{}
+	code := run(
+		nil,
+		func(k string) string { return env[k] },
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+	)
+	if code != 0 || server.health == nil {
+		t.Fatalf("expected a health checker, got code=%d", code)
+	}
+	if server.health.Interval != 2*time.Second || server.health.Path != "/api/v1/health" {
+		t.Fatalf("health settings not applied: interval=%v path=%q", server.health.Interval, server.health.Path)
+	}
+	if status := server.health.Status(); len(status) != 2 {
+		t.Fatalf("expected both pool targets to be checked, got %v", status)
+	}
+
+	env["MPS_UPSTREAM_CHECK_INTERVAL"] = "often"
+	server = &fakeServerStart{}
+	code = run(
+		nil,
+		func(k string) string { return env[k] },
+		server.start,
+		func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+	)
+	if code == 0 || server.called {
+		t.Fatalf("expected non-zero exit for invalid MPS_UPSTREAM_CHECK_INTERVAL, got %d", code)
+	}
+}
+
+func TestRun_RouteCacheAndCoalescing(t *testing.T) {
+	cases := []struct {
+		name      string
+		env       map[string]string
+		wantCache bool
+		wantErr   bool
+	}{
+		{"Default", map[string]string{}, true, false},
+		{"Configured", map[string]string{"MPS_CACHE_SIZE": "50", "MPS_CACHE_TTL": "1m", "MPS_CACHE_NEGATIVE_TTL": "0s"}, true, false},
+		{"Disabled By Size", map[string]string{"MPS_CACHE_SIZE": "0"}, false, false},
+		{"Disabled By TTL", map[string]string{"MPS_CACHE_TTL": "0s"}, false, false},
+		{"Invalid Size", map[string]string{"MPS_CACHE_SIZE": "big"}, false, true},
+		{"Invalid TTL", map[string]string{"MPS_CACHE_NEGATIVE_TTL": "-1s"}, false, true},
+	}
+	for _, c := range cases {
+		getenv := func(k string) string {
+			if k == "MPS_CONNECTION_STRING" {
+				return "postgres://test"
+			}
+			return c.env[k]
+		}
+		server := &fakeServerStart{}
+		code := run(
+			nil,
+			getenv,
+			server.start,
+			func(s string) (db.Manager, error) { return &pgMgr{HealthResult: true}, nil },
+		)
+		if c.wantErr {
+			if code == 0 || server.called {
+				t.Fatalf("%s: expected non-zero exit, got %d", c.name, code)
+			}
+			continue
+		}
+		if code != 0 {
+			t.Fatalf("%s: expected success, got %d", c.name, code)
+		}
+		cache, isCache := server.manager.(*db.CachingManager)
+		if isCache != c.wantCache {
+			t.Fatalf("%s: expected cache=%v, got manager %T", c.name, c.wantCache, server.manager)
+		}
+		// lookups are coalesced whether or not they are cached
+		inner := server.manager
+		if isCache {
+			inner = cache.Manager
+		}
+		if _, ok := inner.(*db.CoalescingManager); !ok {
+			t.Fatalf("%s: expected coalesced lookups, got manager %T", c.name, inner)
+		}
+		if c.name == "Configured" && (cache.Size != 50 || cache.TTL != time.Minute || cache.NegativeTTL != 0) {
+			t.Fatalf("%s: cache settings not applied: %+v", c.name, cache)
+		}
+	}
+}
+
+func TestStartServerReal_ShutdownOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- startServerReal(ctx, &pgMgr{HealthResult: true}, serverConfig{addr: "127.0.0.1:0", target: "mps:3000", drainTimeout: time.Second})
+	}()
+	// give the server a moment to start listening
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for startServerReal to return")
+	}
+}
+
 func TestStartServerReal_InvalidAddr(t *testing.T) {
 	// Provide an invalid TCP address to force net.Listen to fail immediately
-	err := startServerReal(&pgMgr{HealthResult: true}, "badaddr", "mps:3000")
+	err := startServerReal(context.Background(), &pgMgr{HealthResult: true}, serverConfig{addr: "badaddr", target: "mps:3000"})
 	if err == nil {
 		t.Fatalf("expected error from startServerReal with invalid addr")
 	}
@@ -0,0 +1,181 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCacheSize is the default number of GUIDs kept in the route cache
+	DefaultCacheSize = 10000
+	// DefaultCacheTTL is the default time a GUID's MPS instance is cached
+	DefaultCacheTTL = 30 * time.Second
+	// DefaultNegativeCacheTTL is the default time a GUID without an MPS
+	// instance is cached
+	DefaultNegativeCacheTTL = 5 * time.Second
+)
+
+// CachingManager is a Manager that caches the results of Query in a bounded
+// LRU, so routing a device does not hit the database on every connection.
+// Entries expire after TTL, or NegativeTTL for GUIDs without an MPS instance.
+// Failed lookups are not cached. Other methods pass through to the wrapped
+// Manager.
+type CachingManager struct {
+	// Manager is the wrapped database manager
+	Manager Manager
+	// Maximum number of GUIDs to cache, the least recently used are evicted
+	Size int
+	// Time an MPS instance stays cached
+	TTL time.Duration
+	// Time a GUID without an MPS instance stays cached, zero to not cache it
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// Cached GUIDs, most recently used first
+	lru *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	// now returns the current time, overridden in tests
+	now func() time.Time
+}
+
+// cacheEntry is the cached result of a query
+type cacheEntry struct {
+	guid     string
+	instance string
+	expires  time.Time
+}
+
+// CacheStats counts how queries were answered
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// NewCachingManager wraps m with a route cache
+func NewCachingManager(m Manager, size int, ttl, negativeTTL time.Duration) *CachingManager {
+	return &CachingManager{
+		Manager:     m,
+		Size:        size,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+func (c *CachingManager) Connect() (Database, error) {
+	return c.Manager.Connect()
+}
+
+func (c *CachingManager) GetMPSInstance(db Database, guid string) (string, error) {
+	return c.Manager.GetMPSInstance(db, guid)
+}
+
+func (c *CachingManager) Health(ctx context.Context) HealthReport {
+	return c.Manager.Health(ctx)
+}
+
+// Close closes the wrapped Manager
+func (c *CachingManager) Close() error {
+	return Close(c.Manager)
+}
+
+// Query returns the MPS instance of guid, or an empty string if the lookup
+// fails
+func (c *CachingManager) Query(guid string) string {
+	route, _ := c.Lookup(context.Background(), guid)
+	return route.MPSInstance
+}
+
+// Lookup returns the cached route of guid, looking it up in the wrapped
+// Manager when it is not cached or has expired
+func (c *CachingManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	if instance, ok := c.get(guid); ok {
+		c.hits.Add(1)
+		return newRoute(guid, instance)
+	}
+	c.misses.Add(1)
+	route, err := Adapt(c.Manager).Lookup(ctx, guid)
+	switch {
+	case err == nil:
+		c.put(guid, route.MPSInstance)
+	case errors.Is(err, ErrNotFound):
+		c.put(guid, "")
+	}
+	return route, err
+}
+
+// Stats returns the number of cache hits and misses so far and the number of
+// cached GUIDs
+func (c *CachingManager) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: c.lru.Len()}
+}
+
+// Invalidate removes guid from the cache
+func (c *CachingManager) Invalidate(guid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[guid]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *CachingManager) get(guid string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[guid]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(e)
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	return entry.instance, true
+}
+
+func (c *CachingManager) put(guid, instance string) {
+	ttl := c.TTL
+	if instance == "" {
+		ttl = c.NegativeTTL
+	}
+	if ttl <= 0 || c.Size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(ttl)
+	if e, ok := c.entries[guid]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.instance, entry.expires = instance, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[guid] = c.lru.PushFront(&cacheEntry{guid: guid, instance: instance, expires: expires})
+	for c.lru.Len() > c.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an element from the cache, c.mu must be held
+func (c *CachingManager) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).guid)
+}
@@ -0,0 +1,214 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingManager is a Manager that answers queries from a map and counts them
+type countingManager struct {
+	mu        sync.Mutex
+	instances map[string]string
+	queries   map[string]int
+}
+
+func newCountingManager(instances map[string]string) *countingManager {
+	return &countingManager{instances: instances, queries: map[string]int{}}
+}
+
+func (m *countingManager) Connect() (Database, error) {
+	return nil, errors.New("not connected")
+}
+
+func (m *countingManager) GetMPSInstance(db Database, guid string) (string, error) {
+	return m.instances[guid], nil
+}
+
+func (m *countingManager) Health(ctx context.Context) HealthReport {
+	return HealthReport{Backend: "counting", Reachable: true}
+}
+
+func (m *countingManager) Query(guid string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[guid]++
+	return m.instances[guid]
+}
+
+func (m *countingManager) count(guid string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queries[guid]
+}
+
+// lookupManager is a countingManager whose lookups fail with err when set
+type lookupManager struct {
+	*countingManager
+	err error
+}
+
+func (m *lookupManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	instance := m.Query(guid)
+	if m.err != nil {
+		return Route{}, m.err
+	}
+	return newRoute(guid, instance)
+}
+
+// fakeClock is a manually advanced clock for expiring cache entries
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestCache(m Manager, size int) (*CachingManager, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := NewCachingManager(m, size, time.Minute, 10*time.Second)
+	c.now = clock.Now
+	return c, clock
+}
+
+func TestCachingManagerHitsAndMisses(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c, _ := newTestCache(m, 10)
+
+	assert.Equal(t, "mps-a", c.Query("guid-a"))
+	assert.Equal(t, "mps-a", c.Query("guid-a"))
+	assert.Equal(t, "", c.Query("guid-b"))
+	assert.Equal(t, "", c.Query("guid-b"))
+
+	assert.Equal(t, 1, m.count("guid-a"))
+	assert.Equal(t, 1, m.count("guid-b"), "misses are cached too")
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Entries: 2}, c.Stats())
+}
+
+func TestCachingManagerExpiry(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c, clock := newTestCache(m, 10)
+
+	c.Query("guid-a")
+	c.Query("guid-b")
+
+	// the negative entry expires first
+	clock.now = clock.now.Add(10 * time.Second)
+	c.Query("guid-a")
+	c.Query("guid-b")
+	assert.Equal(t, 1, m.count("guid-a"))
+	assert.Equal(t, 2, m.count("guid-b"))
+
+	clock.now = clock.now.Add(50 * time.Second)
+	m.instances["guid-a"] = "mps-b"
+	assert.Equal(t, "mps-b", c.Query("guid-a"))
+	assert.Equal(t, 2, m.count("guid-a"))
+}
+
+func TestCachingManagerEvictsLeastRecentlyUsed(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a", "guid-b": "mps-b", "guid-c": "mps-c"})
+	c, _ := newTestCache(m, 2)
+
+	c.Query("guid-a")
+	c.Query("guid-b")
+	// using guid-a makes guid-b the least recently used
+	c.Query("guid-a")
+	c.Query("guid-c")
+	assert.Equal(t, 2, c.Stats().Entries)
+
+	c.Query("guid-a")
+	c.Query("guid-b")
+	assert.Equal(t, 1, m.count("guid-a"))
+	assert.Equal(t, 2, m.count("guid-b"))
+}
+
+func TestCachingManagerDisabled(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c := NewCachingManager(m, 10, time.Minute, 0)
+	c.Query("guid-b")
+	c.Query("guid-b")
+	assert.Equal(t, 2, m.count("guid-b"), "negative caching is off")
+
+	c = NewCachingManager(m, 0, time.Minute, time.Minute)
+	c.Query("guid-a")
+	c.Query("guid-a")
+	assert.Equal(t, 2, m.count("guid-a"), "a zero size caches nothing")
+	assert.Equal(t, 0, c.Stats().Entries)
+}
+
+func TestCachingManagerInvalidate(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c, _ := newTestCache(m, 10)
+	c.Query("guid-a")
+	c.Invalidate("guid-a")
+	c.Invalidate("guid-b")
+	c.Query("guid-a")
+	assert.Equal(t, 2, m.count("guid-a"))
+}
+
+func TestCachingManagerPassesThrough(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c, _ := newTestCache(m, 10)
+	_, err := c.Connect()
+	assert.Error(t, err)
+	instance, err := c.GetMPSInstance(nil, "guid-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-a", instance)
+	assert.True(t, c.Health(context.Background()).Reachable)
+}
+
+func TestCachingManagerConcurrentUse(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c := NewCachingManager(m, 10, time.Minute, time.Minute)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			assert.Equal(t, "mps-a", c.Query("guid-a"))
+		})
+	}
+	wg.Wait()
+	stats := c.Stats()
+	assert.Equal(t, uint64(20), stats.Hits+stats.Misses)
+}
+
+func TestCachingManagerLookup(t *testing.T) {
+	m := &lookupManager{countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"})}
+	c, _ := newTestCache(m, 10)
+
+	for range 2 {
+		route, err := c.Lookup(context.Background(), "guid-a")
+		assert.NoError(t, err)
+		assert.Equal(t, Route{GUID: "guid-a", MPSInstance: "mps-a"}, route)
+		_, err = c.Lookup(context.Background(), "guid-b")
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	assert.Equal(t, 1, m.count("guid-a"))
+	assert.Equal(t, 1, m.count("guid-b"), "unknown devices are cached too")
+}
+
+func TestCachingManagerSkipsFailures(t *testing.T) {
+	m := &lookupManager{
+		countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"}),
+		err:             fmt.Errorf("%w: connection refused", ErrUnavailable),
+	}
+	c, _ := newTestCache(m, 10)
+
+	_, err := c.Lookup(context.Background(), "guid-a")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, "", c.Query("guid-a"))
+	assert.Equal(t, 0, c.Stats().Entries, "failures are not cached")
+
+	m.err = nil
+	assert.Equal(t, "mps-a", c.Query("guid-a"))
+	assert.Equal(t, 3, m.count("guid-a"))
+}
@@ -0,0 +1,215 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ChainHealthPolicy is how the health of a ChainManager follows from the
+// health of its managers
+type ChainHealthPolicy string
+
+const (
+	// ChainHealthAll is healthy when every manager is reachable
+	ChainHealthAll ChainHealthPolicy = "all"
+	// ChainHealthAny is healthy when at least one manager is reachable
+	ChainHealthAny ChainHealthPolicy = "any"
+)
+
+// ParseChainHealthPolicy returns the policy named s
+func ParseChainHealthPolicy(s string) (ChainHealthPolicy, error) {
+	switch policy := ChainHealthPolicy(s); policy {
+	case ChainHealthAll, ChainHealthAny:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown health policy %q, expected all or any", s)
+}
+
+// ChainManager consults several managers for the MPS instance of a device,
+// such as the old and new database during a migration. The first manager
+// that knows the device wins. A manager that fails does not stop the others
+// from being asked, but a device no manager knows is only reported as not
+// found if none of them failed.
+type ChainManager struct {
+	// Managers in the order they are asked
+	Managers []Manager
+	// Parallel asks every manager at once and takes the first route found,
+	// instead of asking them in order
+	Parallel bool
+	// HealthPolicy decides whether the chain is healthy
+	HealthPolicy ChainHealthPolicy
+}
+
+// chainDatabase holds the database of each manager of a chain, nil for those
+// that failed to connect
+type chainDatabase []Database
+
+// NewChainManager returns a manager asking managers in order, or all at once
+// if parallel is set
+func NewChainManager(managers []Manager, parallel bool, policy ChainHealthPolicy) *ChainManager {
+	return &ChainManager{Managers: managers, Parallel: parallel, HealthPolicy: policy}
+}
+
+// Connect connects every manager, failing only if none of them can connect
+func (c *ChainManager) Connect() (Database, error) {
+	dbs := make(chainDatabase, len(c.Managers))
+	var errs []error
+	for i, m := range c.Managers {
+		db, err := m.Connect()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dbs[i] = db
+	}
+	if len(errs) == len(c.Managers) {
+		return nil, errors.Join(errs...)
+	}
+	return dbs, nil
+}
+
+// Close closes every manager
+func (c *ChainManager) Close() error {
+	var errs []error
+	for _, m := range c.Managers {
+		errs = append(errs, Close(m))
+	}
+	return errors.Join(errs...)
+}
+
+// resolve asks the managers for the MPS instance of a device with find, which
+// returns an empty instance when a manager does not know the device. It
+// returns an empty instance if no manager knows the device, and the first
+// error if one of them failed as well.
+func (c *ChainManager) resolve(ctx context.Context, find func(ctx context.Context, i int) (string, error)) (string, error) {
+	if c.Parallel {
+		return c.resolveParallel(ctx, find)
+	}
+	var firstErr error
+	for i := range c.Managers {
+		instance, err := find(ctx, i)
+		if err == nil && instance != "" {
+			return instance, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// resolveParallel is resolve asking every manager at once. The others are
+// cancelled as soon as one of them knows the device.
+func (c *ChainManager) resolveParallel(ctx context.Context, find func(ctx context.Context, i int) (string, error)) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i        int
+		instance string
+		err      error
+	}
+	results := make(chan result, len(c.Managers))
+	for i := range c.Managers {
+		go func() {
+			instance, err := find(ctx, i)
+			results <- result{i, instance, err}
+		}()
+	}
+	// the error of the earliest manager in the chain is reported
+	errs := make([]error, len(c.Managers))
+	for range c.Managers {
+		r := <-results
+		if r.err == nil && r.instance != "" {
+			return r.instance, nil
+		}
+		errs[r.i] = r.err
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func (c *ChainManager) GetMPSInstance(db Database, guid string) (string, error) {
+	dbs, ok := db.(chainDatabase)
+	if !ok || len(dbs) != len(c.Managers) {
+		return "", errors.New("invalid database type for chain")
+	}
+	return c.resolve(context.Background(), func(ctx context.Context, i int) (string, error) {
+		if dbs[i] == nil {
+			return "", errors.New("invalid db connection")
+		}
+		return c.Managers[i].GetMPSInstance(dbs[i], guid)
+	})
+}
+
+// Lookup returns the route of the device with guid from the first manager
+// that knows it
+func (c *ChainManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	instance, err := c.resolve(ctx, func(ctx context.Context, i int) (string, error) {
+		route, err := Adapt(c.Managers[i]).Lookup(ctx, guid)
+		if errors.Is(err, ErrNotFound) {
+			return "", nil
+		}
+		return route.MPSInstance, err
+	})
+	if err != nil {
+		return Route{}, err
+	}
+	return newRoute(guid, instance)
+}
+
+// Health checks every manager at once and reports them as members. The
+// chain is reachable according to HealthPolicy, and its latency is that of
+// the slowest manager.
+func (c *ChainManager) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Backend: "chain", Members: make([]HealthReport, len(c.Managers))}
+	var wg sync.WaitGroup
+	for i, m := range c.Managers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Members[i] = m.Health(ctx)
+		}()
+	}
+	wg.Wait()
+
+	reachable := 0
+	var errs []string
+	for _, member := range report.Members {
+		report.Latency = max(report.Latency, member.Latency)
+		if member.Reachable {
+			reachable++
+		}
+		if member.Error != "" {
+			errs = append(errs, member.Backend+": "+member.Error)
+		}
+	}
+	if c.HealthPolicy == ChainHealthAny {
+		report.Reachable = reachable > 0
+	} else {
+		report.Reachable = reachable == len(c.Managers)
+	}
+	report.Error = strings.Join(errs, "; ")
+	return report
+}
+
+func (c *ChainManager) Query(guid string) string {
+	route, _ := c.Lookup(context.Background(), guid)
+	return route.MPSInstance
+}
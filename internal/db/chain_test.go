@@ -0,0 +1,185 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainLookup(t *testing.T) {
+	for _, c := range lookupCases {
+		t.Run(c.name, func(t *testing.T) {
+			// the device is in the second route file, if anywhere
+			first := newTestFileManager(t, writeRouteFile(t, "first.yaml", "other-guid: mps-b\n"))
+			p := writeRouteFile(t, "second.yaml", "other-guid: mps-c\n")
+			switch {
+			case c.fail:
+				p += ".missing"
+			case c.stored:
+				p = writeRouteFile(t, "second.yaml", lookupGUID+": \""+c.instance+"\"\n")
+			}
+			chain := NewChainManager([]Manager{first, newTestFileManager(t, p)}, false, ChainHealthAll)
+			db, err := chain.Connect()
+			assert.NoError(t, err, "one manager connected")
+			checkLookup(t, c, chain, db)
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	old := &lookupManager{countingManager: newCountingManager(map[string]string{"guid-a": "mps-old", "guid-b": "mps-old"})}
+	current := &lookupManager{countingManager: newCountingManager(map[string]string{"guid-a": "mps-new", "guid-c": "mps-new"})}
+	chain := NewChainManager([]Manager{current, old}, false, ChainHealthAll)
+	ctx := context.Background()
+
+	route, err := chain.Lookup(ctx, "guid-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-new", route.MPSInstance, "the first manager wins")
+	assert.Equal(t, 0, old.count("guid-a"), "later managers are not asked")
+
+	route, err = chain.Lookup(ctx, "guid-b")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-old", route.MPSInstance, "later managers are asked when the first does not know the device")
+	assert.Equal(t, "mps-new", chain.Query("guid-c"))
+
+	_, err = chain.Lookup(ctx, "guid-d")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// a failing manager does not hide the routes of the others
+	current.err = ErrUnavailable
+	route, err = chain.Lookup(ctx, "guid-b")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-old", route.MPSInstance)
+	// but a device no one knows may be in the failed one
+	_, err = chain.Lookup(ctx, "guid-d")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.NotErrorIs(t, err, ErrNotFound)
+}
+
+func TestChainQueryOnlyManagers(t *testing.T) {
+	chain := NewChainManager([]Manager{
+		newCountingManager(map[string]string{"guid-a": "mps-a"}),
+		newCountingManager(map[string]string{"guid-b": "mps-b"}),
+	}, false, ChainHealthAll)
+	assert.Equal(t, "mps-a", chain.Query("guid-a"))
+	assert.Equal(t, "mps-b", chain.Query("guid-b"))
+	_, err := chain.Lookup(context.Background(), "guid-c")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = chain.Connect()
+	assert.Error(t, err, "no manager connected")
+	_, err = chain.GetMPSInstance(chainDatabase{nil}, "guid-a")
+	assert.Error(t, err, "a database of another chain")
+	_, err = chain.GetMPSInstance(&PostgresManager{}, "guid-a")
+	assert.Error(t, err)
+}
+
+func TestChainParallel(t *testing.T) {
+	slow := newCancellableManager()
+	fast := &lookupManager{countingManager: newCountingManager(map[string]string{"guid-a": "mps-fast"})}
+	chain := NewChainManager([]Manager{slow, fast}, true, ChainHealthAll)
+
+	route, err := chain.Lookup(context.Background(), "guid-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-fast", route.MPSInstance, "the first route found wins")
+	assert.Equal(t, "guid-a", <-slow.started)
+	select {
+	case err := <-slow.cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(3 * time.Second):
+		t.Fatal("the slower lookup was not cancelled")
+	}
+
+	// every manager is waited for before reporting a device as not found
+	close(slow.release)
+	fast.err = ErrUnavailable
+	_, err = chain.Lookup(context.Background(), "guid-b")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	fast.err = nil
+	_, err = chain.Lookup(context.Background(), "guid-b")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestChainLookupCancelled(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		blocked := newCancellableManager()
+		chain := NewChainManager([]Manager{blocked, newCountingManager(map[string]string{"guid-a": "mps-a"})}, parallel, ChainHealthAll)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-blocked.started
+			cancel()
+		}()
+		_, err := chain.Lookup(ctx, "guid-b")
+		assert.ErrorIs(t, err, context.Canceled, "parallel %v", parallel)
+	}
+}
+
+func TestChainHealth(t *testing.T) {
+	up := newTestFileManager(t, writeRouteFile(t, "routes.yaml", "guid-a: mps-a\n"))
+	down := newTestFileManager(t, writeRouteFile(t, "routes.yaml", "guid-a: mps-a\n")+".missing")
+
+	tests := []struct {
+		name      string
+		managers  []Manager
+		policy    ChainHealthPolicy
+		reachable bool
+	}{
+		{"All Up", []Manager{up, up}, ChainHealthAll, true},
+		{"All With One Down", []Manager{up, down}, ChainHealthAll, false},
+		{"Any With One Down", []Manager{down, up}, ChainHealthAny, true},
+		{"Any All Down", []Manager{down, down}, ChainHealthAny, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := NewChainManager(tt.managers, false, tt.policy).Health(context.Background())
+			assert.Equal(t, tt.reachable, report.Reachable)
+			assert.Equal(t, "chain", report.Backend)
+			assert.Len(t, report.Members, len(tt.managers))
+			for i, member := range report.Members {
+				assert.Equal(t, tt.managers[i] == up, member.Reachable)
+			}
+		})
+	}
+
+	report := NewChainManager([]Manager{up, down}, false, ChainHealthAny).Health(context.Background())
+	assert.Contains(t, report.Error, "file: ")
+	data, err := json.Marshal(report)
+	assert.NoError(t, err)
+	var decoded struct {
+		Members []struct {
+			Backend   string `json:"backend"`
+			Reachable bool   `json:"reachable"`
+			Latency   string `json:"latency"`
+		} `json:"members"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Len(t, decoded.Members, 2)
+	assert.NotEmpty(t, decoded.Members[0].Latency)
+}
+
+func TestChainClose(t *testing.T) {
+	a := &closingManager{countingManager: newCountingManager(nil)}
+	b := &closingManager{countingManager: newCountingManager(nil)}
+	chain := NewChainManager([]Manager{a, newCountingManager(nil), b}, false, ChainHealthAll)
+	assert.NoError(t, Close(chain))
+	assert.True(t, a.closed)
+	assert.True(t, b.closed)
+}
+
+func TestParseChainHealthPolicy(t *testing.T) {
+	policy, err := ParseChainHealthPolicy("any")
+	assert.NoError(t, err)
+	assert.Equal(t, ChainHealthAny, policy)
+	policy, err = ParseChainHealthPolicy("all")
+	assert.NoError(t, err)
+	assert.Equal(t, ChainHealthAll, policy)
+	_, err = ParseChainHealthPolicy("most")
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// CoalescingManager is a Manager that collapses concurrent lookups for the
+// same GUID into a single call to the wrapped Manager, whose result is shared
+// by every caller. Other methods pass through to the wrapped Manager.
+type CoalescingManager struct {
+	// Manager is the wrapped database manager
+	Manager Manager
+
+	mu sync.Mutex
+	// Lookups in flight by GUID
+	calls map[string]*queryCall
+}
+
+// queryCall is a lookup in flight
+type queryCall struct {
+	done  chan struct{}
+	route Route
+	err   error
+	// Number of callers still waiting for the lookup, which is cancelled
+	// once they have all given up
+	waiting int
+	cancel  context.CancelFunc
+}
+
+// NewCoalescingManager wraps m so that concurrent lookups for a GUID are
+// coalesced
+func NewCoalescingManager(m Manager) *CoalescingManager {
+	return &CoalescingManager{Manager: m, calls: map[string]*queryCall{}}
+}
+
+func (c *CoalescingManager) Connect() (Database, error) {
+	return c.Manager.Connect()
+}
+
+func (c *CoalescingManager) GetMPSInstance(db Database, guid string) (string, error) {
+	return c.Manager.GetMPSInstance(db, guid)
+}
+
+func (c *CoalescingManager) Health(ctx context.Context) HealthReport {
+	return c.Manager.Health(ctx)
+}
+
+// Close closes the wrapped Manager
+func (c *CoalescingManager) Close() error {
+	return Close(c.Manager)
+}
+
+// Query returns the MPS instance of guid, or an empty string if the lookup
+// fails
+func (c *CoalescingManager) Query(guid string) string {
+	route, _ := c.Lookup(context.Background(), guid)
+	return route.MPSInstance
+}
+
+// Lookup returns the route of guid, waiting for a lookup already in flight
+// for it instead of starting another. A caller that gives up when its ctx is
+// done leaves the lookup running for the others.
+func (c *CoalescingManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	c.mu.Lock()
+	call, ok := c.calls[guid]
+	if ok {
+		call.waiting++
+	} else {
+		// the lookup outlives the caller that started it
+		lookupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &queryCall{done: make(chan struct{}), waiting: 1, cancel: cancel}
+		c.calls[guid] = call
+		go c.lookup(lookupCtx, guid, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.route, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiting--
+		if call.waiting == 0 {
+			call.cancel()
+			c.forget(guid, call)
+		}
+		c.mu.Unlock()
+		return Route{}, ctx.Err()
+	}
+}
+
+// lookup runs call and releases its waiters
+func (c *CoalescingManager) lookup(ctx context.Context, guid string, call *queryCall) {
+	// release the waiters even if the lookup panics
+	defer func() {
+		c.mu.Lock()
+		c.forget(guid, call)
+		c.mu.Unlock()
+		call.cancel()
+		close(call.done)
+	}()
+	call.route, call.err = Adapt(c.Manager).Lookup(ctx, guid)
+}
+
+// forget stops sharing call with new callers, c.mu must be held
+func (c *CoalescingManager) forget(guid string, call *queryCall) {
+	if c.calls[guid] == call {
+		delete(c.calls, guid)
+	}
+}
@@ -0,0 +1,236 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingManager is a countingManager whose queries wait for release
+type blockingManager struct {
+	*countingManager
+	started chan string
+	release chan struct{}
+}
+
+func (m *blockingManager) Query(guid string) string {
+	m.started <- guid
+	<-m.release
+	return m.countingManager.Query(guid)
+}
+
+// cancellableManager is a countingManager whose lookups wait for release or
+// for their ctx to be done, which is reported on cancelled
+type cancellableManager struct {
+	*blockingManager
+	cancelled chan error
+}
+
+func (m *cancellableManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	m.started <- guid
+	select {
+	case <-m.release:
+		return newRoute(guid, m.countingManager.Query(guid))
+	case <-ctx.Done():
+		m.cancelled <- ctx.Err()
+		return Route{}, ctx.Err()
+	}
+}
+
+func newCancellableManager() *cancellableManager {
+	return &cancellableManager{
+		blockingManager: &blockingManager{
+			countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"}),
+			started:         make(chan string, 2),
+			release:         make(chan struct{}),
+		},
+		cancelled: make(chan error, 2),
+	}
+}
+
+// waitForWaiters waits until n callers are waiting for the query in flight for
+// guid
+func waitForWaiters(t *testing.T, c *CoalescingManager, guid string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		call := c.calls[guid]
+		waiting := call != nil && call.waiting == n
+		c.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d callers of the query for %s", n, guid)
+}
+
+func TestCoalescingManagerSharesQuery(t *testing.T) {
+	m := &blockingManager{
+		countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"}),
+		started:         make(chan string, 20),
+		release:         make(chan struct{}),
+	}
+	c := NewCoalescingManager(m)
+
+	results := make(chan string, 20)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() { results <- c.Query("guid-a") })
+	}
+	assert.Equal(t, "guid-a", <-m.started)
+	waitForWaiters(t, c, "guid-a", 20)
+	close(m.release)
+	wg.Wait()
+	close(results)
+
+	for instance := range results {
+		assert.Equal(t, "mps-a", instance)
+	}
+	assert.Equal(t, 1, m.count("guid-a"))
+	assert.Empty(t, c.calls)
+}
+
+func TestCoalescingManagerSeparatesGUIDs(t *testing.T) {
+	m := &blockingManager{
+		countingManager: newCountingManager(map[string]string{"guid-a": "mps-a", "guid-b": "mps-b"}),
+		started:         make(chan string, 2),
+		release:         make(chan struct{}),
+	}
+	c := NewCoalescingManager(m)
+
+	var a, b string
+	var wg sync.WaitGroup
+	wg.Go(func() { a = c.Query("guid-a") })
+	wg.Go(func() { b = c.Query("guid-b") })
+	// both queries are in flight at once
+	assert.ElementsMatch(t, []string{"guid-a", "guid-b"}, []string{<-m.started, <-m.started})
+	close(m.release)
+	wg.Wait()
+
+	assert.Equal(t, "mps-a", a)
+	assert.Equal(t, "mps-b", b)
+}
+
+func TestCoalescingManagerQueriesAgainAfterCompletion(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	c := NewCoalescingManager(m)
+	assert.Equal(t, "mps-a", c.Query("guid-a"))
+	m.instances["guid-a"] = "mps-b"
+	assert.Equal(t, "mps-b", c.Query("guid-a"))
+	assert.Equal(t, 2, m.count("guid-a"))
+}
+
+func TestCoalescingManagerPassesThrough(t *testing.T) {
+	c := NewCoalescingManager(newCountingManager(map[string]string{"guid-a": "mps-a"}))
+	_, err := c.Connect()
+	assert.Error(t, err)
+	instance, err := c.GetMPSInstance(nil, "guid-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-a", instance)
+	assert.True(t, c.Health(context.Background()).Reachable)
+}
+
+// closingManager is a countingManager that records being closed
+type closingManager struct {
+	*countingManager
+	closed bool
+}
+
+func (m *closingManager) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestWrappedManagerClose(t *testing.T) {
+	m := &closingManager{countingManager: newCountingManager(nil)}
+	c := NewCachingManager(NewCoalescingManager(m), 10, time.Minute, time.Second)
+	assert.NoError(t, Close(c))
+	assert.True(t, m.closed)
+
+	// managers without connections to close are skipped
+	assert.NoError(t, Close(NewCoalescingManager(newCountingManager(nil))))
+}
+
+func TestCachingCoalescingManager(t *testing.T) {
+	m := &blockingManager{
+		countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"}),
+		started:         make(chan string, 20),
+		release:         make(chan struct{}),
+	}
+	coalescer := NewCoalescingManager(m)
+	c := NewCachingManager(coalescer, 10, time.Minute, time.Second)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() { assert.Equal(t, "mps-a", c.Query("guid-a")) })
+	}
+	<-m.started
+	waitForWaiters(t, coalescer, "guid-a", 20)
+	close(m.release)
+	wg.Wait()
+
+	// later queries are answered from the cache
+	assert.Equal(t, "mps-a", c.Query("guid-a"))
+	assert.Equal(t, 1, m.count("guid-a"))
+}
+
+func TestCoalescingManagerLookupOutlivesCaller(t *testing.T) {
+	m := newCancellableManager()
+	c := NewCoalescingManager(m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.Lookup(ctx, "guid-a")
+		first <- err
+	}()
+	<-m.started
+	second := make(chan Route, 1)
+	go func() {
+		route, err := c.Lookup(context.Background(), "guid-a")
+		assert.NoError(t, err)
+		second <- route
+	}()
+	waitForWaiters(t, c, "guid-a", 2)
+
+	// the caller that started the lookup gives up, the other still waits
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(m.release)
+	assert.Equal(t, Route{GUID: "guid-a", MPSInstance: "mps-a"}, <-second)
+	assert.Empty(t, m.cancelled)
+}
+
+func TestCoalescingManagerCancelsAbandonedLookup(t *testing.T) {
+	m := newCancellableManager()
+	defer close(m.release)
+	c := NewCoalescingManager(m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-m.started
+		cancel()
+	}()
+	_, err := c.Lookup(ctx, "guid-a")
+	assert.ErrorIs(t, err, context.Canceled)
+	select {
+	case err := <-m.cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(3 * time.Second):
+		t.Fatal("abandoned lookup was not cancelled")
+	}
+
+	// later callers do not join the abandoned lookup
+	c.mu.Lock()
+	assert.Empty(t, c.calls)
+	c.mu.Unlock()
+}
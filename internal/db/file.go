@@ -0,0 +1,322 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFilePollInterval is how often a route file is checked for changes
+const DefaultFilePollInterval = 5 * time.Second
+
+// FileManager reads the MPS instance of devices from a static route table, for
+// setups without a database. The table is a YAML or JSON map, or a CSV file
+// of guid,instance rows:
+//
+//	4c4c4544-0035-5910-804b-b2c04f4e4e32: mps-0:3000
+//	4c4c4544-*: mps-1:3000
+//	"*": mps-2:3000
+//
+// Keys may be glob patterns as understood by path.Match. A GUID matches its
+// own entry first, then the longest matching pattern, so "*" serves as the
+// default. GUIDs are matched case-insensitively. The file is reloaded when it
+// changes, and the previous table stays in use if the new one is invalid.
+type FileManager struct {
+	// Path of the route table
+	Path string
+	// PollInterval is how often the file is checked for changes, zero to
+	// never reload it
+	PollInterval time.Duration
+
+	// mu guards the fields below
+	mu    sync.Mutex
+	table *routeTable
+	// Modification time and size of the file when it was last read
+	modTime time.Time
+	size    int64
+	// Error of the last attempt to read the file, nil if it succeeded
+	lastErr error
+	// Stops watching the file, nil when not watching
+	stopWatching context.CancelFunc
+	watching     sync.WaitGroup
+}
+
+// routeTable is a loaded route file, which is never modified
+type routeTable struct {
+	exact map[string]string
+	// Patterns in the order they are tried
+	patterns []routePattern
+}
+
+type routePattern struct {
+	pattern  string
+	instance string
+}
+
+// NewFileManager returns a manager for the route file named by a
+// file:// connection string. The poll interval is read from
+// MPS_FILE_POLL_INTERVAL.
+func NewFileManager(connectionString string) *FileManager {
+	pollInterval := DefaultFilePollInterval
+	if value, ok := os.LookupEnv("MPS_FILE_POLL_INTERVAL"); ok {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			pollInterval = d
+		} else {
+			log.Println("invalid MPS_FILE_POLL_INTERVAL:", value)
+		}
+	}
+	return &FileManager{
+		Path:         strings.TrimPrefix(connectionString, "file://"),
+		PollInterval: pollInterval,
+	}
+}
+
+// Connect loads the route table on first use and starts watching the file for
+// changes. It returns the current table.
+func (f *FileManager) Connect() (Database, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.table == nil {
+		if err := f.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	if f.stopWatching == nil && f.PollInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		f.stopWatching = cancel
+		f.watching.Add(1)
+		go f.watch(ctx)
+	}
+	return f.table, nil
+}
+
+// Close stops watching the file and forgets the table
+func (f *FileManager) Close() error {
+	f.mu.Lock()
+	stop := f.stopWatching
+	f.stopWatching, f.table = nil, nil
+	f.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	f.watching.Wait()
+	return nil
+}
+
+// Reload reads the route file again. The current table is kept if the file
+// cannot be read or is invalid.
+func (f *FileManager) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loadLocked()
+}
+
+// loadLocked reads the route file, f.mu must be held
+func (f *FileManager) loadLocked() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		f.lastErr = err
+		return err
+	}
+	// an invalid file is not read again until it changes
+	f.modTime, f.size = info.ModTime(), info.Size()
+	table, err := readRouteFile(f.Path)
+	f.lastErr = err
+	if err != nil {
+		return err
+	}
+	f.table = table
+	return nil
+}
+
+// watch reloads the file whenever it changes until ctx is done
+func (f *FileManager) watch(ctx context.Context) {
+	defer f.watching.Done()
+	ticker := time.NewTicker(f.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.reloadIfChanged()
+		}
+	}
+}
+
+// reloadIfChanged reloads the file if it differs from the one last loaded
+func (f *FileManager) reloadIfChanged() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		if f.lastErr == nil {
+			log.Println("Error checking route file:", err)
+		}
+		f.lastErr = err
+		return
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+	if err := f.loadLocked(); err != nil {
+		log.Println("Error reloading route file:", err)
+		return
+	}
+	log.Println("Reloaded routes from", f.Path)
+}
+
+// readRouteFile reads and parses the route file at name
+func readRouteFile(name string) (*routeTable, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		// JSON is accepted since it is valid YAML
+		err = yaml.Unmarshal(data, &entries)
+	case ".csv":
+		entries, err = parseRouteCSV(data)
+	default:
+		err = errors.New("unknown format, expected .yaml, .yml, .json or .csv")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("route file %s: %w", name, err)
+	}
+	table, err := newRouteTable(entries)
+	if err != nil {
+		return nil, fmt.Errorf("route file %s: %w", name, err)
+	}
+	return table, nil
+}
+
+// parseRouteCSV decodes guid,instance rows, skipping a header row naming the
+// columns
+func parseRouteCSV(data []byte) (map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	entries := map[string]string{}
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && strings.EqualFold(record[0], "guid") {
+			continue
+		}
+		if _, ok := entries[record[0]]; ok {
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("line %d: duplicate entry for %q", line, record[0])
+		}
+		entries[record[0]] = record[1]
+	}
+}
+
+// newRouteTable indexes entries by GUID and orders the patterns among them
+func newRouteTable(entries map[string]string) (*routeTable, error) {
+	t := &routeTable{exact: map[string]string{}}
+	for key, instance := range entries {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			return nil, errors.New("entry without a GUID")
+		}
+		if !strings.ContainsAny(key, `*?[\`) {
+			t.exact[key] = instance
+			continue
+		}
+		if _, err := path.Match(key, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", key, err)
+		}
+		t.patterns = append(t.patterns, routePattern{pattern: key, instance: instance})
+	}
+	slices.SortFunc(t.patterns, func(a, b routePattern) int {
+		if n := len(b.pattern) - len(a.pattern); n != 0 {
+			return n
+		}
+		return strings.Compare(a.pattern, b.pattern)
+	})
+	return t, nil
+}
+
+// lookup returns the MPS instance of guid, empty if no entry matches
+func (t *routeTable) lookup(guid string) string {
+	guid = strings.ToLower(guid)
+	if instance, ok := t.exact[guid]; ok {
+		return instance
+	}
+	for _, p := range t.patterns {
+		if ok, _ := path.Match(p.pattern, guid); ok {
+			return p.instance
+		}
+	}
+	return ""
+}
+
+func (f *FileManager) GetMPSInstance(db Database, guid string) (string, error) {
+	table, ok := db.(*routeTable)
+	if !ok || table == nil {
+		return "", errors.New("invalid database type for route file")
+	}
+	return table.lookup(guid), nil
+}
+
+// Lookup returns the route of the device with guid from the route table
+func (f *FileManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	db, err := f.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, db.(*routeTable).lookup(guid))
+}
+
+// Health reports whether the route table is loaded. A file that changed and
+// can no longer be read is reported as an error while the previous table
+// stays in use.
+func (f *FileManager) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Backend: "file"}
+	start := time.Now()
+	_, _ = f.Connect()
+	report.Latency = time.Since(start)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	report.Reachable = f.table != nil
+	if f.lastErr != nil {
+		report.Error = f.lastErr.Error()
+	}
+	return report
+}
+
+func (f *FileManager) Query(guid string) string {
+	db, err := f.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	instance, _ := f.GetMPSInstance(db, guid)
+	return instance
+}
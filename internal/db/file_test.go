@@ -0,0 +1,195 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeRouteFile writes a route file named name in a temporary directory
+func writeRouteFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write route file: %v", err)
+	}
+	return p
+}
+
+// newTestFileManager returns a manager for the route file at p that does not
+// watch it
+func newTestFileManager(t *testing.T, p string) *FileManager {
+	t.Helper()
+	t.Setenv("MPS_FILE_POLL_INTERVAL", "0")
+	f := NewFileManager("file://" + p)
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+func TestFileLookup(t *testing.T) {
+	for _, c := range lookupCases {
+		t.Run(c.name, func(t *testing.T) {
+			p := writeRouteFile(t, "routes.yaml", "other-guid: mps-b\n")
+			switch {
+			case c.fail:
+				p += ".missing"
+			case c.stored:
+				p = writeRouteFile(t, "routes.yaml", lookupGUID+": \""+c.instance+"\"\n")
+			}
+			f := newTestFileManager(t, p)
+			db, _ := f.Connect()
+			checkLookup(t, c, f, db)
+		})
+	}
+}
+
+func TestFileFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"routes.yaml", "guid-a: mps-a:3000\nguid-b: mps-b\n"},
+		{"routes.yml", "guid-a: mps-a:3000\nguid-b: mps-b\n"},
+		{"routes.json", `{"guid-a": "mps-a:3000", "guid-b": "mps-b"}`},
+		{"routes.csv", "guid,mpsinstance\nguid-a,mps-a:3000\n# lab bench\nguid-b, mps-b\n"},
+		{"headless.csv", "guid-a,mps-a:3000\nguid-b,mps-b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFileManager(t, writeRouteFile(t, tt.name, tt.content))
+			assert.Equal(t, "mps-a:3000", f.Query("guid-a"))
+			assert.Equal(t, "mps-b", f.Query("guid-b"))
+			assert.Equal(t, "", f.Query("guid-c"))
+		})
+	}
+}
+
+func TestFileWildcards(t *testing.T) {
+	f := newTestFileManager(t, writeRouteFile(t, "routes.yaml", `
+4c4c4544-0035-5910-804b-b2c04f4e4e32: mps-exact
+4c4c4544-0035-*: mps-long
+4c4c4544-*: mps-short
+"*": mps-default
+4c4c4544-0035-5910-804b-000000000000: ""
+`))
+	tests := []struct {
+		guid string
+		want string
+	}{
+		{"4c4c4544-0035-5910-804b-b2c04f4e4e32", "mps-exact"},
+		{"4C4C4544-0035-5910-804B-B2C04F4E4E32", "mps-exact"},
+		{"4c4c4544-0035-5910-804b-111111111111", "mps-long"},
+		{"4c4c4544-0099-5910-804b-111111111111", "mps-short"},
+		{"11111111-2222-3333-4444-555555555555", "mps-default"},
+		// an explicit empty entry keeps a device off the default
+		{"4c4c4544-0035-5910-804b-000000000000", ""},
+	}
+	for _, tt := range tests {
+		route, err := f.Lookup(context.Background(), tt.guid)
+		if tt.want == "" {
+			assert.ErrorIs(t, err, ErrNotFound, tt.guid)
+			continue
+		}
+		assert.NoError(t, err, tt.guid)
+		assert.Equal(t, tt.want, route.MPSInstance, tt.guid)
+	}
+}
+
+func TestFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"routes.yaml", "guid-a: [mps-a, mps-b]\n"},
+		{"routes.json", `{"guid-a": `},
+		{"routes.csv", "guid-a,mps-a,extra\n"},
+		{"routes.csv", "guid-a,mps-a\nguid-a,mps-b\n"},
+		{"routes.yaml", "\"[\": mps-a\n"},
+		{"routes.yaml", "\" \": mps-a\n"},
+		{"routes.txt", "guid-a mps-a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFileManager(t, writeRouteFile(t, tt.name, tt.content))
+			_, err := f.Connect()
+			assert.Error(t, err)
+			_, err = f.Lookup(context.Background(), "guid-a")
+			assert.ErrorIs(t, err, ErrUnavailable)
+
+			report := f.Health(context.Background())
+			assert.False(t, report.Reachable)
+			assert.Contains(t, report.Error, tt.name)
+		})
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	p := writeRouteFile(t, "routes.yaml", "guid-a: mps-a\n")
+	t.Setenv("MPS_FILE_POLL_INTERVAL", "10ms")
+	f := NewFileManager("file://" + p)
+	defer func() { _ = f.Close() }()
+	assert.Equal(t, 10*time.Millisecond, f.PollInterval)
+	assert.Equal(t, "mps-a", f.Query("guid-a"))
+
+	waitFor := func(cond func() bool, msg string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	assert.NoError(t, os.WriteFile(p, []byte("guid-a: mps-b\n"), 0o600))
+	waitFor(func() bool { return f.Query("guid-a") == "mps-b" }, "route file change was not picked up")
+
+	// a broken file is reported while the previous table stays in use
+	assert.NoError(t, os.WriteFile(p, []byte("guid-a: [\n"), 0o600))
+	waitFor(func() bool { return f.Health(context.Background()).Error != "" }, "broken route file was not reported")
+	report := f.Health(context.Background())
+	assert.True(t, report.Reachable)
+	assert.Equal(t, "file", report.Backend)
+	assert.Equal(t, "mps-b", f.Query("guid-a"))
+
+	assert.NoError(t, os.WriteFile(p, []byte("guid-a: mps-c\nguid-b: mps-d\n"), 0o600))
+	waitFor(func() bool { return f.Query("guid-b") == "mps-d" }, "fixed route file was not picked up")
+	assert.Empty(t, f.Health(context.Background()).Error)
+}
+
+func TestFileManagerReloadKeepsTable(t *testing.T) {
+	p := writeRouteFile(t, "routes.csv", "guid-a,mps-a\n")
+	f := newTestFileManager(t, p)
+	assert.Equal(t, "mps-a", f.Query("guid-a"))
+
+	assert.NoError(t, os.WriteFile(p, []byte("guid-a\n"), 0o600))
+	assert.Error(t, f.Reload())
+	assert.Equal(t, "mps-a", f.Query("guid-a"))
+
+	assert.NoError(t, os.WriteFile(p, []byte("guid-a,mps-b\n"), 0o600))
+	assert.NoError(t, f.Reload())
+	assert.Equal(t, "mps-b", f.Query("guid-a"))
+}
+
+func TestNewFileManager(t *testing.T) {
+	t.Setenv("MPS_FILE_POLL_INTERVAL", "")
+	f := NewFileManager("file:///etc/mps/routes.yaml")
+	assert.Equal(t, "/etc/mps/routes.yaml", f.Path)
+	assert.Equal(t, DefaultFilePollInterval, f.PollInterval, "invalid intervals fall back to the default")
+
+	f = NewFileManager("file://routes.csv")
+	assert.Equal(t, "routes.csv", f.Path)
+
+	m, err := New("file:///etc/mps/routes.yaml")
+	assert.NoError(t, err)
+	assert.IsType(t, &FileManager{}, m)
+}
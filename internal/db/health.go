@@ -0,0 +1,81 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// HealthReport describes the state of the database connection
+type HealthReport struct {
+	// Backend is the kind of database, such as "postgres" or "mongodb"
+	Backend string `json:"backend"`
+	// Reachable is whether the database answered the health check
+	Reachable bool `json:"reachable"`
+	// Latency is how long the health check took
+	Latency time.Duration `json:"-"`
+	// Version of the database server, when reachable
+	Version string `json:"version,omitempty"`
+	// Pool describes the connection pool, when one has been created
+	Pool *PoolStats `json:"pool,omitempty"`
+	// Error is why the health check failed
+	Error string `json:"error,omitempty"`
+	// Members are the reports of the databases combined by a ChainManager
+	Members []HealthReport `json:"members,omitempty"`
+}
+
+// MarshalJSON renders the report with a human readable latency
+func (r HealthReport) MarshalJSON() ([]byte, error) {
+	type report HealthReport
+	return json.Marshal(struct {
+		report
+		Latency string `json:"latency"`
+	}{report(r), r.Latency.String()})
+}
+
+// PoolStats counts the connections of a connection pool
+type PoolStats struct {
+	// Maximum number of open connections, zero for no limit
+	MaxOpen int `json:"max_open"`
+	// Number of open connections, in use or idle
+	Open int `json:"open"`
+	// Number of connections in use
+	InUse int `json:"in_use"`
+	// Number of idle connections
+	Idle int `json:"idle"`
+}
+
+// poolCounter counts the connections of a Mongo client from its pool events
+type poolCounter struct {
+	maxOpen atomic.Int64
+	open    atomic.Int64
+	inUse   atomic.Int64
+}
+
+// monitor returns a pool monitor that updates the counts
+func (p *poolCounter) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.ConnectionCreated:
+			p.open.Add(1)
+		case event.ConnectionClosed:
+			p.open.Add(-1)
+		case event.GetSucceeded:
+			p.inUse.Add(1)
+		case event.ConnectionReturned:
+			p.inUse.Add(-1)
+		}
+	}}
+}
+
+// stats returns the current counts
+func (p *poolCounter) stats() *PoolStats {
+	open, inUse := int(p.open.Load()), int(p.inUse.Load())
+	return &PoolStats{MaxOpen: int(p.maxOpen.Load()), Open: open, InUse: inUse, Idle: max(open-inUse, 0)}
+}
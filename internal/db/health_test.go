@@ -0,0 +1,76 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestHealthReportJSON(t *testing.T) {
+	report := HealthReport{
+		Backend:   "postgres",
+		Reachable: true,
+		Latency:   1500 * time.Microsecond,
+		Version:   "16.4",
+		Pool:      &PoolStats{MaxOpen: 10, Open: 3, InUse: 1, Idle: 2},
+	}
+	data, err := report.MarshalJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"backend": "postgres",
+		"reachable": true,
+		"latency": "1.5ms",
+		"version": "16.4",
+		"pool": {"max_open": 10, "open": 3, "in_use": 1, "idle": 2}
+	}`, string(data))
+
+	data, err = HealthReport{Backend: "mongodb", Error: "connection refused"}.MarshalJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"backend": "mongodb", "reachable": false, "latency": "0s", "error": "connection refused"}`, string(data))
+}
+
+func TestPoolCounter(t *testing.T) {
+	var p poolCounter
+	p.maxOpen.Store(5)
+	monitor := p.monitor()
+	for _, kind := range []string{
+		event.ConnectionCreated, event.ConnectionCreated, event.ConnectionCreated,
+		event.GetSucceeded, event.GetSucceeded, event.ConnectionReturned,
+		event.ConnectionClosed, event.PoolReady,
+	} {
+		monitor.Event(&event.PoolEvent{Type: kind})
+	}
+	assert.Equal(t, &PoolStats{MaxOpen: 5, Open: 2, InUse: 1, Idle: 1}, p.stats())
+}
+
+func TestMongoHealth(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("reachable", func(mt *mtest.T) {
+		m := &MongoManager{client: mt.Client}
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "version", Value: "7.0.12"}))
+
+		report := m.Health(context.Background())
+		assert.True(mt, report.Reachable)
+		assert.Equal(mt, "mongodb", report.Backend)
+		assert.Equal(mt, "7.0.12", report.Version)
+		assert.NotNil(mt, report.Pool)
+		assert.Equal(mt, "buildInfo", mt.GetStartedEvent().CommandName)
+	})
+	mt.Run("failing", func(mt *mtest.T) {
+		m := &MongoManager{client: mt.Client}
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "unauthorized"}))
+
+		report := m.Health(context.Background())
+		assert.False(mt, report.Reachable)
+		assert.Contains(mt, report.Error, "unauthorized")
+	})
+}
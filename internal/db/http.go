@@ -0,0 +1,311 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHTTPResponseBytes bounds the size of a lookup response
+	maxHTTPResponseBytes = 1 << 20
+	// healthGUID is looked up to check the service when no health URL is set
+	healthGUID = "00000000-0000-0000-0000-000000000000"
+)
+
+// errHTTPNotFound is returned by the lookup service for unknown devices
+var errHTTPNotFound = errors.New("device not found by the lookup service")
+
+// HTTPManager asks a lookup service over HTTP for the MPS instance of
+// devices. The service answers GET requests to URL with
+//
+//	{"instance": "mps-0:3000"}
+//
+// and either 404 or an empty instance for devices it does not know.
+type HTTPManager struct {
+	// URL of the lookup, with {guid} replaced by the GUID of the device. The
+	// GUID is added as the guid query parameter when there is no {guid}.
+	URL string
+	// HealthURL is requested by Health when set. Otherwise Health looks up a
+	// GUID no device has.
+	HealthURL string
+	// Token is sent as a bearer token when set
+	Token string
+	// CAFile is a PEM file of the certificate authorities trusted for TLS,
+	// empty for the system roots
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key for mutual TLS,
+	// empty for none
+	CertFile string
+	KeyFile  string
+
+	// mu guards client, which is created on first use and shared by all callers
+	mu     sync.Mutex
+	client *http.Client
+}
+
+// lookupResponse is the body of a successful lookup
+type lookupResponse struct {
+	Instance string `json:"instance"`
+}
+
+// NewHTTPManager returns a manager for the lookup service at connectionString.
+// The health URL, token and TLS files are read from MPS_HTTP_HEALTH_URL,
+// MPS_HTTP_TOKEN, MPS_HTTP_CA_FILE, MPS_HTTP_CERT_FILE and MPS_HTTP_KEY_FILE.
+func NewHTTPManager(connectionString string) *HTTPManager {
+	return &HTTPManager{
+		URL:       connectionString,
+		HealthURL: os.Getenv("MPS_HTTP_HEALTH_URL"),
+		Token:     os.Getenv("MPS_HTTP_TOKEN"),
+		CAFile:    os.Getenv("MPS_HTTP_CA_FILE"),
+		CertFile:  os.Getenv("MPS_HTTP_CERT_FILE"),
+		KeyFile:   os.Getenv("MPS_HTTP_KEY_FILE"),
+	}
+}
+
+// Connect returns the manager's HTTP client, creating it on first use. The
+// client keeps its own connection pool and is safe to share across
+// goroutines. MPS_DB_MAX_OPEN_CONNS limits the connections to the service,
+// MPS_DB_CONNECT_TIMEOUT bounds connecting to it and MPS_DB_QUERY_TIMEOUT
+// bounds each request.
+func (h *HTTPManager) Connect() (Database, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client != nil {
+		return h.client, nil
+	}
+
+	if _, err := url.Parse(h.lookupURL(healthGUID)); err != nil {
+		return nil, err
+	}
+	transport, err := h.transport()
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Creating lookup service client")
+	h.client = &http.Client{Transport: transport, Timeout: queryTimeout()}
+	return h.client, nil
+}
+
+// transport builds the client transport from the TLS files and the pool
+// settings in the environment
+func (h *HTTPManager) transport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if value, ok := os.LookupEnv("MPS_DB_MAX_OPEN_CONNS"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		transport.MaxConnsPerHost = n
+		transport.MaxIdleConnsPerHost = n
+	}
+	if value, ok := os.LookupEnv("MPS_DB_CONNECT_TIMEOUT"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = (&net.Dialer{Timeout: d}).DialContext
+		transport.TLSHandshakeTimeout = d
+	}
+
+	if h.CAFile == "" && h.CertFile == "" && h.KeyFile == "" {
+		return transport, nil
+	}
+	config, err := loadTLSConfig(h.CAFile, h.CertFile, h.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// loadTLSConfig returns a client TLS configuration trusting the certificate
+// authorities in caFile, or the system roots if it is empty, and presenting
+// the certificate in certFile and keyFile if they are set
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Close closes the idle connections of the client, if one was created. The
+// next call to Connect creates a new one.
+func (h *HTTPManager) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client != nil {
+		h.client.CloseIdleConnections()
+		h.client = nil
+	}
+	return nil
+}
+
+// lookupURL returns the URL looking up guid, which is escaped to be safe in
+// both the path and the query
+func (h *HTTPManager) lookupURL(guid string) string {
+	escaped := strings.ReplaceAll(url.QueryEscape(guid), "+", "%20")
+	if strings.Contains(h.URL, "{guid}") {
+		return strings.ReplaceAll(h.URL, "{guid}", escaped)
+	}
+	sep := "?"
+	if strings.Contains(h.URL, "?") {
+		sep = "&"
+	}
+	return h.URL + sep + "guid=" + escaped
+}
+
+// get sends an authenticated GET request for target
+func (h *HTTPManager) get(ctx context.Context, client *http.Client, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	return client.Do(req)
+}
+
+// fetch asks the service for the MPS instance of guid, failing with
+// errHTTPNotFound when it does not know the device
+func (h *HTTPManager) fetch(ctx context.Context, client *http.Client, guid string) (string, error) {
+	resp, err := h.get(ctx, client, h.lookupURL(guid))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errHTTPNotFound
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("lookup service responded %s", resp.Status)
+	}
+	var body lookupResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxHTTPResponseBytes)).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid lookup response: %w", err)
+	}
+	return body.Instance, nil
+}
+
+func (h *HTTPManager) GetMPSInstance(db Database, guid string) (string, error) {
+	client, ok := db.(*http.Client)
+	if !ok || client == nil {
+		return "", errors.New("invalid database type for HTTP")
+	}
+	instance, err := h.fetch(context.Background(), client, guid)
+	switch {
+	case errors.Is(err, errHTTPNotFound):
+		log.Println("device was not found!")
+		return "", nil
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return "", err
+	}
+	return instance, nil
+}
+
+// Lookup returns the route of the device with guid, cancelling the request
+// when ctx is done
+func (h *HTTPManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	client, err := h.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return Route{}, lookupError(ctx, err)
+	}
+	instance, err := h.fetch(ctx, client.(*http.Client), guid)
+	switch {
+	case errors.Is(err, errHTTPNotFound):
+		return Route{}, ErrNotFound
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, instance)
+}
+
+// Health reports whether the service answers, requesting HealthURL if set and
+// otherwise looking up a GUID no device has, which the service must answer
+// with 200 or 404. The Server header of the response is reported as the
+// version.
+func (h *HTTPManager) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Backend: "http"}
+	client, err := h.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+
+	target := h.HealthURL
+	if target == "" {
+		target = h.lookupURL(healthGUID)
+	}
+	start := time.Now()
+	resp, err := h.get(ctx, client.(*http.Client), target)
+	report.Latency = time.Since(start)
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	_ = resp.Body.Close()
+	report.Version = resp.Header.Get("Server")
+	healthy := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if h.HealthURL == "" && resp.StatusCode == http.StatusNotFound {
+		healthy = true
+	}
+	if !healthy {
+		report.Error = "lookup service responded " + resp.Status
+		return report
+	}
+	report.Reachable = true
+	return report
+}
+
+func (h *HTTPManager) Query(guid string) string {
+	client, err := h.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	instance, err := h.GetMPSInstance(client, guid)
+	if err != nil {
+		return ""
+	}
+	return instance
+}
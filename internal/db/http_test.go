@@ -0,0 +1,281 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHTTPManager returns a manager for the lookup service at url without
+// any settings from the environment
+func newTestHTTPManager(t *testing.T, url string) *HTTPManager {
+	t.Helper()
+	for _, key := range []string{"MPS_HTTP_HEALTH_URL", "MPS_HTTP_TOKEN", "MPS_HTTP_CA_FILE", "MPS_HTTP_CERT_FILE", "MPS_HTTP_KEY_FILE"} {
+		t.Setenv(key, "")
+	}
+	h := NewHTTPManager(url)
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+// writePEM writes blocks to a PEM file in a temporary directory
+func writePEM(t *testing.T, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(b)...)
+	}
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return p
+}
+
+func TestHTTPLookup(t *testing.T) {
+	for _, c := range lookupCases {
+		t.Run(c.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case c.fail:
+					http.Error(w, "lookup failed", http.StatusInternalServerError)
+				case c.stored && r.URL.Query().Get("guid") == lookupGUID:
+					_, _ = w.Write([]byte(`{"instance": "` + c.instance + `"}`))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+			h := newTestHTTPManager(t, ts.URL+"/lookup?guid={guid}")
+			client, err := h.Connect()
+			assert.NoError(t, err)
+			checkLookup(t, c, h, client)
+		})
+	}
+}
+
+func TestHTTPLookupRequest(t *testing.T) {
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		_, _ = w.Write([]byte(`{"instance": "mps-a", "tenant": "t1"}`))
+	}))
+	defer ts.Close()
+
+	h := newTestHTTPManager(t, ts.URL+"/devices/{guid}/route")
+	h.Token = "secret"
+	route, err := h.Lookup(context.Background(), "guid a&b")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-a", route.MPSInstance)
+	assert.Equal(t, "/devices/guid a&b/route", got.URL.Path)
+	assert.Equal(t, "Bearer secret", got.Header.Get("Authorization"))
+	assert.Equal(t, "application/json", got.Header.Get("Accept"))
+
+	// without a placeholder the GUID is a query parameter
+	h = newTestHTTPManager(t, ts.URL+"/lookup?tenant=t1")
+	_, err = h.Lookup(context.Background(), lookupGUID)
+	assert.NoError(t, err)
+	assert.Equal(t, lookupGUID, got.URL.Query().Get("guid"))
+	assert.Equal(t, "t1", got.URL.Query().Get("tenant"))
+	assert.Empty(t, got.Header.Get("Authorization"))
+}
+
+func TestHTTPLookupInvalidResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"Not JSON", http.StatusOK, "mps-a"},
+		{"Truncated", http.StatusOK, `{"instance": `},
+		{"Wrong Type", http.StatusOK, `{"instance": 3000}`},
+		{"Unauthorized", http.StatusUnauthorized, ""},
+		{"Bad Gateway", http.StatusBadGateway, `{"instance": "mps-a"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+			h := newTestHTTPManager(t, ts.URL)
+			_, err := h.Lookup(context.Background(), lookupGUID)
+			assert.ErrorIs(t, err, ErrUnavailable)
+			assert.Equal(t, "", h.Query(lookupGUID))
+		})
+	}
+}
+
+func TestHTTPLookupCancelled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	h := newTestHTTPManager(t, ts.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := h.Lookup(ctx, lookupGUID)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"instance": "mps-a"}`))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the client presents the server's own certificate
+	cert := ts.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+	caFile := writePEM(t, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	certFile := writePEM(t, "cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyFile := writePEM(t, "key.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: key})
+
+	h := newTestHTTPManager(t, ts.URL)
+	h.CAFile, h.CertFile, h.KeyFile = caFile, certFile, keyFile
+	route, err := h.Lookup(context.Background(), lookupGUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-a", route.MPSInstance)
+
+	// without a certificate the service refuses the lookup
+	h = newTestHTTPManager(t, ts.URL)
+	h.CAFile = caFile
+	_, err = h.Lookup(context.Background(), lookupGUID)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// and the server is not trusted without the CA
+	h = newTestHTTPManager(t, ts.URL)
+	_, err = h.Lookup(context.Background(), lookupGUID)
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+func TestHTTPConnectInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"Max Conns", map[string]string{"MPS_DB_MAX_OPEN_CONNS": "lots"}},
+		{"Timeout", map[string]string{"MPS_DB_CONNECT_TIMEOUT": "soon"}},
+		{"Missing CA", map[string]string{"MPS_HTTP_CA_FILE": "missing.pem"}},
+		{"Empty CA", map[string]string{"MPS_HTTP_CA_FILE": os.DevNull}},
+		{"Key Without Cert", map[string]string{"MPS_HTTP_KEY_FILE": "key.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHTTPManager(t, "https://inventory.example/lookup?guid={guid}")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			h = NewHTTPManager(h.URL)
+			_, err := h.Connect()
+			assert.Error(t, err)
+			_, err = h.Lookup(context.Background(), lookupGUID)
+			assert.ErrorIs(t, err, ErrUnavailable)
+			assert.False(t, h.Health(context.Background()).Reachable)
+		})
+	}
+}
+
+func TestHTTPConnectReusesClient(t *testing.T) {
+	h := newTestHTTPManager(t, "http://inventory.example/lookup")
+	first, err := h.Connect()
+	assert.NoError(t, err)
+	second, err := h.Connect()
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+
+	assert.NoError(t, Close(h))
+	third, err := h.Connect()
+	assert.NoError(t, err)
+	assert.NotSame(t, first, third)
+}
+
+func TestHTTPHealth(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "inventory/1.2")
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+
+	h := newTestHTTPManager(t, ts.URL+"/lookup?guid={guid}")
+	report := h.Health(context.Background())
+	assert.True(t, report.Reachable, "a lookup of an unknown device succeeds")
+	assert.Equal(t, "http", report.Backend)
+	assert.Equal(t, "inventory/1.2", report.Version)
+
+	status = http.StatusForbidden
+	report = h.Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.Contains(t, report.Error, "403")
+
+	h.HealthURL = ts.URL + "/healthz"
+	assert.True(t, h.Health(context.Background()).Reachable)
+	h.HealthURL = ts.URL + "/missing"
+	status = http.StatusNotFound
+	assert.False(t, h.Health(context.Background()).Reachable, "a health URL must answer 2xx")
+
+	ts.Close()
+	report = h.Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.NotEmpty(t, report.Error)
+}
+
+func TestHTTPGetMPSInstanceInvalidDatabase(t *testing.T) {
+	h := newTestHTTPManager(t, "http://inventory.example/lookup")
+	_, err := h.GetMPSInstance(&PostgresManager{}, lookupGUID)
+	assert.Error(t, err)
+	var client *http.Client
+	_, err = h.GetMPSInstance(client, lookupGUID)
+	assert.Error(t, err)
+}
+
+func TestNewHTTPManager(t *testing.T) {
+	t.Setenv("MPS_HTTP_TOKEN", "secret")
+	t.Setenv("MPS_HTTP_CA_FILE", "ca.pem")
+	t.Setenv("MPS_HTTP_CERT_FILE", "cert.pem")
+	t.Setenv("MPS_HTTP_KEY_FILE", "key.pem")
+	t.Setenv("MPS_HTTP_HEALTH_URL", "https://inventory/healthz")
+	h := NewHTTPManager("https://inventory/lookup?guid={guid}")
+	assert.Equal(t, &HTTPManager{
+		URL:       "https://inventory/lookup?guid={guid}",
+		HealthURL: "https://inventory/healthz",
+		Token:     "secret",
+		CAFile:    "ca.pem",
+		CertFile:  "cert.pem",
+		KeyFile:   "key.pem",
+	}, h)
+	assert.Equal(t, "https://inventory/lookup?guid=a%2Fb", h.lookupURL("a/b"))
+
+	for _, cs := range []string{"http://inventory/lookup", "https://inventory/lookup"} {
+		m, err := New(cs)
+		assert.NoError(t, err)
+		assert.IsType(t, &HTTPManager{}, m)
+	}
+}
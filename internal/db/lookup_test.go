@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// lookupCase is a device lookup that every backend must answer the same way
+type lookupCase struct {
+	name string
+	// Whether the device is stored, and its MPS instance
+	stored   bool
+	instance string
+	// Whether the database fails the lookup
+	fail bool
+
+	want    string
+	wantErr bool
+	// Error expected from Lookup
+	wantLookupErr error
+}
+
+var lookupCases = []lookupCase{
+	{name: "found", stored: true, instance: "mps-a", want: "mps-a"},
+	{name: "found without instance", stored: true, instance: "", want: "", wantLookupErr: ErrNotFound},
+	{name: "not found", want: "", wantLookupErr: ErrNotFound},
+	{name: "failure", fail: true, wantErr: true, wantLookupErr: ErrUnavailable},
+}
+
+const lookupGUID = "11111111-1111-1111-1111-111111111111"
+
+// checkLookup asserts that GetMPSInstance, Query and Lookup agree with c
+func checkLookup(t *testing.T, c lookupCase, m RouteManager, db Database) {
+	t.Helper()
+	instance, err := m.GetMPSInstance(db, lookupGUID)
+	if c.wantErr {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, c.want, instance)
+	assert.Equal(t, c.want, m.Query(lookupGUID), "Query returns the same instance, or empty on failure")
+
+	route, err := m.Lookup(context.Background(), lookupGUID)
+	if c.wantLookupErr != nil {
+		assert.ErrorIs(t, err, c.wantLookupErr)
+		assert.Equal(t, Route{}, route)
+	} else {
+		assert.NoError(t, err)
+		assert.Equal(t, Route{GUID: lookupGUID, MPSInstance: c.want}, route)
+	}
+}
+
+func TestPostgresLookup(t *testing.T) {
+	for _, c := range lookupCases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+			defer func() { _ = db.Close() }()
+			pm := &PostgresManager{connection: db}
+
+			// once each for GetMPSInstance, Query and Lookup
+			for range 3 {
+				query := mock.ExpectQuery(postgresDeviceQuery).WithArgs(lookupGUID)
+				rows := sqlmock.NewRows([]string{"guid", "mpsinstance"})
+				switch {
+				case c.fail:
+					query.WillReturnError(assert.AnError)
+				case c.stored:
+					query.WillReturnRows(rows.AddRow(lookupGUID, c.instance))
+				default:
+					query.WillReturnRows(rows)
+				}
+			}
+
+			checkLookup(t, c, pm, db)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMongoLookup(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, c := range lookupCases {
+		mt.Run(c.name, func(mt *mtest.T) {
+			m := &MongoManager{DatabaseName: "mpsdb", CollectionName: "devices", client: mt.Client}
+			ns := "mpsdb.devices"
+
+			// once each for GetMPSInstance, Query and Lookup
+			for range 3 {
+				switch {
+				case c.fail:
+					mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "lookup failed"}))
+				case c.stored:
+					doc := bson.D{{Key: "guid", Value: lookupGUID}, {Key: "mpsinstance", Value: c.instance}}
+					mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, doc))
+				default:
+					mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+				}
+			}
+
+			checkLookup(mt.T, c, m, mt.Client)
+
+			started := mt.GetStartedEvent()
+			if assert.NotNil(mt, started) {
+				assert.Equal(mt, "find", started.CommandName)
+				assert.Equal(mt, "mpsdb", started.DatabaseName)
+			}
+		})
+	}
+}
+
+func TestMongoGetMPSInstanceInvalidDatabase(t *testing.T) {
+	m := NewMongoManager("mongodb://localhost:27017")
+	_, err := m.GetMPSInstance(&PostgresManager{}, lookupGUID)
+	assert.Error(t, err)
+	var client *mongo.Client
+	_, err = m.GetMPSInstance(client, lookupGUID)
+	assert.Error(t, err)
+}
+
+func TestPostgresLookupCancelled(t *testing.T) {
+	db, mock := newSQLMock(t)
+	defer func() { _ = db.Close() }()
+	pm := &PostgresManager{connection: db}
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(lookupGUID).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"guid", "mpsinstance"}).AddRow(lookupGUID, "mps-a"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pm.Lookup(ctx, lookupGUID)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrUnavailable)
+}
+
+func TestLookupConnectFailure(t *testing.T) {
+	m := NewMongoManager("not-a-valid-uri")
+	_, err := m.Lookup(context.Background(), lookupGUID)
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+func TestAdapt(t *testing.T) {
+	m := newCountingManager(map[string]string{"guid-a": "mps-a"})
+	adapted := Adapt(m)
+	route, err := adapted.Lookup(context.Background(), "guid-a")
+	assert.NoError(t, err)
+	assert.Equal(t, Route{GUID: "guid-a", MPSInstance: "mps-a"}, route)
+	_, err = adapted.Lookup(context.Background(), "guid-b")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// managers that already implement Lookup are used as is
+	pm := NewPostgresManager("")
+	assert.Same(t, pm, Adapt(pm))
+}
+
+func TestAdaptCancelled(t *testing.T) {
+	m := &blockingManager{
+		countingManager: newCountingManager(map[string]string{"guid-a": "mps-a"}),
+		started:         make(chan string, 1),
+		release:         make(chan struct{}),
+	}
+	defer close(m.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-m.started
+		cancel()
+	}()
+	_, err := Adapt(m).Lookup(ctx, "guid-a")
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -1,6 +1,17 @@
 // Package db provides abstractions for database operations.
 package db
 
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
 // Database represents a universal database object.
 // For different databases, different underlying types can be used.
 // For example, MongoDB would use a *mongo.Client, and SQL would use *sql.DB.
@@ -16,15 +27,82 @@ type Manager interface {
 	// GetMPSInstance fetches the MPS instance associated with the given GUID from the specified Database.
 	GetMPSInstance(db Database, guid string) (string, error)
 
-	// Health checks the status of the database connection.
-	// It returns true if the connection is healthy; otherwise false.
-	Health() bool
+	// Health checks the status of the database connection and reports it.
+	// The connection is healthy if the report is Reachable.
+	Health(ctx context.Context) HealthReport
 
 	// Query retrieves a result from the database based on the provided GUID.
 	// The implementation details can vary depending on the underlying database.
 	Query(guid string) string
 }
 
+// New returns the Manager for connectionString, chosen by its scheme:
+// mongodb:// and mongodb+srv:// for MongoDB, mysql:// for MySQL, sqlite:// for
+// SQLite, redis:// and rediss:// for Redis, etcd:// and etcds:// for etcd,
+// file:// for a route file, http:// and https:// for a lookup service, and
+// PostgreSQL otherwise.
+func New(connectionString string) (Manager, error) {
+	scheme, _, _ := strings.Cut(connectionString, "://")
+	switch scheme {
+	case "mongodb", "mongodb+srv":
+		return NewMongoManager(connectionString), nil
+	case "file":
+		return NewFileManager(connectionString), nil
+	case "sqlite":
+		return NewSQLiteManager(connectionString), nil
+	case "http", "https":
+		return NewHTTPManager(connectionString), nil
+	case "etcd", "etcds":
+		e, err := NewEtcdManager(connectionString)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.Start(); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case "mysql":
+		if _, err := mysqlDSN(connectionString); err != nil {
+			return nil, err
+		}
+		return NewMySQLManager(connectionString), nil
+	case "redis", "rediss":
+		if _, err := redis.ParseURL(connectionString); err != nil {
+			return nil, err
+		}
+		return NewRedisManager(connectionString), nil
+	}
+	pm := NewPostgresManager(connectionString)
+	if _, err := pm.deviceQuery(); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// Close releases the connections held by m, if it holds any. Managers that
+// keep a connection open implement io.Closer.
+func Close(m Manager) error {
+	if c, ok := m.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// defaultQueryTimeout bounds a single lookup
+const defaultQueryTimeout = 10 * time.Second
+
+// queryTimeout returns the time allowed for a lookup, set by
+// MPS_DB_QUERY_TIMEOUT
+func queryTimeout() time.Duration {
+	if value, ok := os.LookupEnv("MPS_DB_QUERY_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Println("invalid MPS_DB_QUERY_TIMEOUT:", value)
+	}
+	return defaultQueryTimeout
+}
+
 // Device represents a database entity with information about a device.
 // It includes a globally unique identifier (GUID) and an associated MPS instance, if available.
 type Device struct {
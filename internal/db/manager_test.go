@@ -0,0 +1,43 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		connectionString string
+		want             Manager
+	}{
+		{"mongodb://localhost:27017", &MongoManager{}},
+		{"mongodb+srv://atlas.test", &MongoManager{}},
+		{"redis://localhost:6379", &RedisManager{}},
+		{"rediss://localhost:6380", &RedisManager{}},
+		{"postgres://localhost:5432", &PostgresManager{}},
+		{"host=localhost dbname=mps", &PostgresManager{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.connectionString, func(t *testing.T) {
+			m, err := New(tt.connectionString)
+			assert.NoError(t, err)
+			assert.IsType(t, tt.want, m)
+		})
+	}
+
+	_, err := New("redis://localhost:6379/not-a-db")
+	assert.Error(t, err)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	t.Setenv("MPS_DB_QUERY_TIMEOUT", "2s")
+	assert.Equal(t, 2*time.Second, queryTimeout())
+	t.Setenv("MPS_DB_QUERY_TIMEOUT", "never")
+	assert.Equal(t, defaultQueryTimeout, queryTimeout())
+}
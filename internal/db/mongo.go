@@ -5,8 +5,11 @@ import (
 	"errors"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -20,8 +23,21 @@ type MongoManager struct {
 	DatabaseName string
 	// CollectionName is the name of the collection to use. Default is "devices"
 	CollectionName string
+
+	// mu guards client, which is created on first use and shared by all callers
+	mu     sync.Mutex
+	client *mongo.Client
+	// Connections of the client's pool
+	pool poolCounter
 }
 
+const (
+	// defaultMongoConnectTimeout bounds connecting and selecting a server
+	defaultMongoConnectTimeout = 10 * time.Second
+	// defaultMongoMaxPoolSize is the driver's limit on open connections
+	defaultMongoMaxPoolSize = 100
+)
+
 func NewMongoManager(connectionString string) *MongoManager {
 	databaseName := os.Getenv("MPS_DATABASE_NAME")
 	if databaseName == "" {
@@ -38,81 +54,181 @@ func NewMongoManager(connectionString string) *MongoManager {
 	}
 }
 
+// Connect returns the manager's client, creating it on first use. The client
+// keeps its own connection pool and is safe to share across goroutines. The
+// pool is sized by MPS_DB_MAX_OPEN_CONNS and MPS_DB_MIN_POOL_SIZE, and
+// MPS_DB_CONNECT_TIMEOUT bounds connecting to the database.
 func (m *MongoManager) Connect() (Database, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(m.ConnectionString))
+	opts, err := m.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	maxOpen := int64(defaultMongoMaxPoolSize)
+	if opts.MaxPoolSize != nil {
+		maxOpen = int64(*opts.MaxPoolSize)
+	}
+	m.pool.maxOpen.Store(maxOpen)
+	log.Println("Creating database client")
+	ctx, cancel := context.WithTimeout(context.Background(), *opts.ConnectTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
+	m.client = client
 
 	return client, nil
 }
 
-func (m *MongoManager) GetMPSInstance(db Database, guid string) (string, error) {
-	return "", errors.New("not implemented")
+// clientOptions builds the client options from the connection string and
+// the pool settings in the environment
+func (m *MongoManager) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(m.ConnectionString)
+	if value, ok := os.LookupEnv("MPS_DB_MAX_OPEN_CONNS"); ok {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetMaxPoolSize(n)
+	}
+	if value, ok := os.LookupEnv("MPS_DB_MIN_POOL_SIZE"); ok {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetMinPoolSize(n)
+	}
+	timeout := defaultMongoConnectTimeout
+	if value, ok := os.LookupEnv("MPS_DB_CONNECT_TIMEOUT"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		timeout = d
+	}
+	opts.SetConnectTimeout(timeout)
+	opts.SetServerSelectionTimeout(timeout)
+	opts.SetPoolMonitor(m.pool.monitor())
+	return opts, opts.Validate()
 }
 
-func (m *MongoManager) Health() bool {
-	client, err := m.Connect()
-	if err != nil {
-		log.Println(err.Error())
-		return false
+// Close disconnects the client, if one was created. The next call to Connect
+// creates a new one.
+func (m *MongoManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultMongoConnectTimeout)
+	defer cancel()
+	err := m.client.Disconnect(ctx)
+	m.client = nil
+	return err
+}
 
-	// We'll cast our generic Database type back to a *mongo.Client.
-	mongoClient, ok := client.(*mongo.Client)
+func (m *MongoManager) GetMPSInstance(db Database, guid string) (string, error) {
+	client, ok := db.(*mongo.Client)
 	if !ok {
-		return false
+		return "", errors.New("invalid database type for MongoDB")
+	}
+	if client == nil {
+		return "", errors.New("invalid db connection")
 	}
-	defer func() {
-		if err := mongoClient.Disconnect(context.Background()); err != nil {
-			log.Printf("Failed to disconnect from db: %v", err)
-		}
-	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	device, err := m.findDevice(context.Background(), client, guid)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		log.Println("no documents were returned!")
+		return "", nil
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return "", err
+	}
+	return device.MPSinstance, nil
+}
 
-	// Using Ping to check the health.
-	err = mongoClient.Ping(ctx, nil)
+// Lookup returns the route of the device with guid, cancelling the query when
+// ctx is done
+func (m *MongoManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	client, err := m.Connect()
 	if err != nil {
 		log.Println(err.Error())
-		return false
+		return Route{}, lookupError(ctx, err)
 	}
-	return true
+	device, err := m.findDevice(ctx, client.(*mongo.Client), guid)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return Route{}, ErrNotFound
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, device.MPSinstance)
 }
 
-func (m *MongoManager) Query(guid string) string {
+// findDevice reads the device with guid, failing with mongo.ErrNoDocuments if
+// there is none. The query is bounded by MPS_DB_QUERY_TIMEOUT.
+func (m *MongoManager) findDevice(ctx context.Context, client *mongo.Client, guid string) (Device, error) {
+	collection := client.Database(m.DatabaseName).Collection(m.CollectionName)
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout())
+	defer cancel()
+
+	var device Device
+	err := collection.FindOne(ctx, bson.M{"guid": guid}).Decode(&device)
+	return device, err
+}
+
+// Health reports whether the database answers a buildInfo command, along
+// with its version and the state of the connection pool
+func (m *MongoManager) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Backend: "mongodb"}
 	client, err := m.Connect()
 	if err != nil {
 		log.Println(err.Error())
-		return ""
+		report.Error = err.Error()
+		return report
 	}
 
 	// We'll cast our generic Database type back to a *mongo.Client.
 	mongoClient, ok := client.(*mongo.Client)
 	if !ok {
-		return ""
+		report.Error = "invalid database type for MongoDB"
+		return report
 	}
-	defer func() {
-		if err := mongoClient.Disconnect(context.Background()); err != nil {
-			log.Printf("Failed to disconnect from db: %v", err)
-		}
-	}()
 
-	// Using the same logic as in GetMPSInstance to fetch the MPSinstance.
-	collection := mongoClient.Database(m.DatabaseName).Collection(m.CollectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	start := time.Now()
+	var info struct {
+		Version string `bson:"version"`
+	}
+	err = mongoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+	report.Latency = time.Since(start)
+	report.Pool = m.pool.stats()
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	report.Version = info.Version
+	report.Reachable = true
+	return report
+}
 
-	var device Device
-	err = collection.FindOne(ctx, map[string]interface{}{"guid": guid}).Decode(&device)
+func (m *MongoManager) Query(guid string) string {
+	client, err := m.Connect()
 	if err != nil {
 		log.Println(err.Error())
 		return ""
 	}
-
-	return device.MPSinstance
+	mpsInstance, err := m.GetMPSInstance(client, guid)
+	if err != nil {
+		return ""
+	}
+	return mpsInstance
 }
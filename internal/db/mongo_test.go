@@ -1,7 +1,10 @@
 package db
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,8 +23,13 @@ func TestNoSQLHealth(t *testing.T) {
 	manager := &MongoManager{
 		ConnectionString: "mongodb://localhost:27017",
 	}
-	result := manager.Health()
-	assert.Equal(t, false, result)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report := manager.Health(ctx)
+	assert.Equal(t, false, report.Reachable)
+	assert.Equal(t, "mongodb", report.Backend)
+	assert.NotEmpty(t, report.Error)
+	assert.Equal(t, 100, report.Pool.MaxOpen)
 }
 
 func TestNoSQLGetMPSInstance(t *testing.T) {
@@ -62,8 +70,10 @@ func TestMongoHealth_TypeAssertionFailure(t *testing.T) {
 	}
 	// We can't easily inject a bad type, but we can test with invalid connection string
 	manager.ConnectionString = "invalid://connection"
-	result := manager.Health()
-	assert.False(t, result)
+	report := manager.Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.NotEmpty(t, report.Error)
+	assert.Nil(t, report.Pool, "no client was created")
 }
 
 func TestMongoQuery_ConnectionError(t *testing.T) {
@@ -94,3 +104,60 @@ func TestMongoConnect_InvalidConnectionString(t *testing.T) {
 	_, err := manager.Connect()
 	assert.Error(t, err)
 }
+
+func TestMongoConnectReusesClient(t *testing.T) {
+	manager := NewMongoManager("mongodb://localhost:27017")
+	first, err := manager.Connect()
+	assert.NoError(t, err)
+
+	clients := make(chan Database, 10)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			client, err := manager.Connect()
+			assert.NoError(t, err)
+			clients <- client
+		})
+	}
+	wg.Wait()
+	close(clients)
+	for client := range clients {
+		assert.Same(t, first, client)
+	}
+
+	assert.NoError(t, manager.Close())
+	assert.NoError(t, manager.Close(), "closing twice is harmless")
+	second, err := manager.Connect()
+	assert.NoError(t, err)
+	assert.NotSame(t, first, second, "a closed client is replaced")
+	assert.NoError(t, Close(manager))
+}
+
+func TestMongoClientOptions(t *testing.T) {
+	t.Setenv("MPS_DB_MAX_OPEN_CONNS", "50")
+	t.Setenv("MPS_DB_MIN_POOL_SIZE", "5")
+	t.Setenv("MPS_DB_CONNECT_TIMEOUT", "3s")
+	manager := NewMongoManager("mongodb://localhost:27017")
+	opts, err := manager.clientOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50), *opts.MaxPoolSize)
+	assert.Equal(t, uint64(5), *opts.MinPoolSize)
+	assert.Equal(t, 3*time.Second, *opts.ConnectTimeout)
+	assert.Equal(t, 3*time.Second, *opts.ServerSelectionTimeout)
+}
+
+func TestMongoClientOptionsInvalid(t *testing.T) {
+	cases := map[string]string{
+		"MPS_DB_MAX_OPEN_CONNS":  "lots",
+		"MPS_DB_MIN_POOL_SIZE":   "-1",
+		"MPS_DB_CONNECT_TIMEOUT": "soon",
+	}
+	for key, value := range cases {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			manager := NewMongoManager("mongodb://localhost:27017")
+			_, err := manager.Connect()
+			assert.Error(t, err)
+		})
+	}
+}
@@ -5,61 +5,163 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// maxPostgresIdentifierLength is the longest identifier PostgreSQL keeps
+// without truncating it
+const maxPostgresIdentifierLength = 63
+
+// PostgresManager reads the MPS instance of devices from a table of a
+// PostgreSQL database. The names of the table and its columns are quoted, so
+// they are case-sensitive and may be any valid identifier.
 type PostgresManager struct {
 	ConnectionString string
-	connection       *sql.DB
+	// Schema of the table, empty for the search path
+	Schema string
+	// Table of devices. Default is "devices"
+	Table string
+	// GUIDColumn holds the GUID of a device. Default is "guid"
+	GUIDColumn string
+	// InstanceColumn holds the MPS instance of a device. Default is
+	// "mpsinstance"
+	InstanceColumn string
+	// TenantColumn restricts lookups to the devices of Tenant when set. The
+	// two are set together or not at all.
+	TenantColumn string
+	Tenant       string
+
+	// mu guards connection, which is created on first use and shared by all
+	// callers
+	mu         sync.Mutex
+	connection *sql.DB
 }
 
+// NewPostgresManager returns a manager for the database at connectionString.
+// The names of the devices table and its columns are read from
+// MPS_POSTGRES_SCHEMA, MPS_POSTGRES_TABLE, MPS_POSTGRES_GUID_COLUMN,
+// MPS_POSTGRES_INSTANCE_COLUMN and MPS_POSTGRES_TENANT_COLUMN, and the tenant
+// from MPS_POSTGRES_TENANT.
 func NewPostgresManager(connectionString string) *PostgresManager {
 	return &PostgresManager{
 		ConnectionString: connectionString,
+		Schema:           os.Getenv("MPS_POSTGRES_SCHEMA"),
+		Table:            os.Getenv("MPS_POSTGRES_TABLE"),
+		GUIDColumn:       os.Getenv("MPS_POSTGRES_GUID_COLUMN"),
+		InstanceColumn:   os.Getenv("MPS_POSTGRES_INSTANCE_COLUMN"),
+		TenantColumn:     os.Getenv("MPS_POSTGRES_TENANT_COLUMN"),
+		Tenant:           os.Getenv("MPS_POSTGRES_TENANT"),
+	}
+}
+
+// deviceQuery returns the query reading the GUID and MPS instance of a device
+// by its GUID, and by tenant when there is a tenant column. It fails if one
+// of the names is not a valid identifier, or if only one of the tenant column
+// and the tenant is set.
+func (pm *PostgresManager) deviceQuery() (string, error) {
+	if pm.TenantColumn != "" && pm.Tenant == "" {
+		return "", errors.New("tenant column is set without a tenant")
+	}
+	if pm.Tenant != "" && pm.TenantColumn == "" {
+		return "", errors.New("tenant is set without a tenant column")
+	}
+	names := []struct {
+		setting, name, def string
+	}{
+		{"schema", pm.Schema, ""},
+		{"table", pm.Table, "devices"},
+		{"GUID column", pm.GUIDColumn, "guid"},
+		{"instance column", pm.InstanceColumn, "mpsinstance"},
+		{"tenant column", pm.TenantColumn, ""},
+	}
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		name := n.name
+		if name == "" {
+			name = n.def
+		}
+		if name == "" {
+			continue
+		}
+		if err := checkPostgresIdentifier(name); err != nil {
+			return "", fmt.Errorf("invalid %s: %w", n.setting, err)
+		}
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	schema, table, guid, instance, tenant := quoted[0], quoted[1], quoted[2], quoted[3], quoted[4]
+
+	if schema != "" {
+		table = schema + "." + table
+	}
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = $1", guid, instance, table, guid)
+	if tenant != "" {
+		query += fmt.Sprintf(" AND %s = $2", tenant)
+	}
+	return query + ";", nil
+}
+
+// checkPostgresIdentifier fails if name cannot be used as an identifier
+func checkPostgresIdentifier(name string) error {
+	if len(name) > maxPostgresIdentifierLength {
+		return fmt.Errorf("%q is longer than %d bytes", name, maxPostgresIdentifierLength)
+	}
+	if !utf8.ValidString(name) || strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("%q contains invalid characters", name)
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("%q has leading or trailing spaces", name)
 	}
+	return nil
 }
 
 func (pm *PostgresManager) Connect() (Database, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 	if pm.connection != nil {
 		return pm.connection, nil
 	}
 
-	log.Println("Creating database connection pool")
-	db, err := sql.Open("postgres", pm.ConnectionString)
+	db, err := openPool("postgres", pm.ConnectionString)
 	if err != nil {
 		return nil, err
 	}
 
-	if maxOpenConnsStr, ok := os.LookupEnv("MPS_DB_MAX_OPEN_CONNS"); ok {
-		maxOpenConns, err := strconv.Atoi(maxOpenConnsStr)
-		if err != nil {
-			return nil, err
-		}
-
-		db.SetMaxOpenConns(maxOpenConns)
-	}
-
 	pm.connection = db
 
 	return db, nil
 }
 
+// Close closes the connection pool, if one was created
+func (pm *PostgresManager) Close() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.connection == nil {
+		return nil
+	}
+	err := pm.connection.Close()
+	pm.connection = nil
+	return err
+}
+
 func (pm *PostgresManager) GetMPSInstance(db Database, guid string) (string, error) {
 	client, ok := db.(*sql.DB)
 	if !ok {
 		return "", errors.New("invalid database type for PostgreSQL")
 	}
-	var device Device
-	deviceSql := "SELECT guid, mpsinstance FROM devices WHERE guid = $1;"
 	if client != nil {
-		row := client.QueryRow(deviceSql, guid)
-		switch err := row.Scan(&device.GUID, &device.MPSinstance); err {
+		device, err := pm.findDevice(context.Background(), client, guid)
+		switch err {
 		case sql.ErrNoRows:
 			log.Println("no rows were returned!")
 		case nil:
@@ -77,19 +179,51 @@ func (pm *PostgresManager) GetMPSInstance(db Database, guid string) (string, err
 	return "", errors.New("invalid db connection")
 }
 
-func (pm *PostgresManager) Health() bool {
+// Lookup returns the route of the device with guid, cancelling the query when
+// ctx is done
+func (pm *PostgresManager) Lookup(ctx context.Context, guid string) (Route, error) {
 	db, err := pm.Connect()
 	if err != nil {
 		log.Println("Failed to open a DB connection: ", err)
-		return false
+		return Route{}, lookupError(ctx, err)
 	}
+	device, err := pm.findDevice(ctx, db.(*sql.DB), guid)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Route{}, ErrNotFound
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, device.MPSinstance)
+}
 
-	result := db.(*sql.DB).QueryRow("SELECT 1")
-	if result.Err() != nil {
-		log.Println(result.Err().Error())
-		return false
+// findDevice reads the device with guid, failing with sql.ErrNoRows if there
+// is none
+func (pm *PostgresManager) findDevice(ctx context.Context, client *sql.DB, guid string) (Device, error) {
+	var device Device
+	deviceSql, err := pm.deviceQuery()
+	if err != nil {
+		return device, err
+	}
+	args := []any{guid}
+	if pm.TenantColumn != "" {
+		args = append(args, pm.Tenant)
+	}
+	row := client.QueryRowContext(ctx, deviceSql, args...)
+	err = row.Scan(&device.GUID, &device.MPSinstance)
+	return device, err
+}
+
+// Health reports whether the database answers a query, along with its
+// version and the state of the connection pool
+func (pm *PostgresManager) Health(ctx context.Context) HealthReport {
+	db, err := pm.Connect()
+	if err != nil {
+		log.Println("Failed to open a DB connection: ", err)
+		return HealthReport{Backend: "postgres", Error: err.Error()}
 	}
-	return true
+	return sqlHealth(ctx, "postgres", db.(*sql.DB), "SHOW server_version")
 }
 
 func (pm *PostgresManager) Query(guid string) string {
@@ -1,13 +1,19 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"strings"
 	"testing"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 )
 
+// postgresDeviceQuery matches the device query with the default names
+const postgresDeviceQuery = `SELECT "guid", "mpsinstance" FROM "devices" WHERE "guid" = \$1;`
+
 func newSQLMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -24,7 +30,7 @@ func TestGetMPSInstance_Success(t *testing.T) {
 
 	guid := "11111111-1111-1111-1111-111111111111"
 	rows := sqlmock.NewRows([]string{"guid", "mpsinstance"}).AddRow(guid, "mps-host")
-	mock.ExpectQuery(`SELECT guid, mpsinstance FROM devices WHERE guid = \$1;`).WithArgs(guid).WillReturnRows(rows)
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(guid).WillReturnRows(rows)
 
 	// Connect should return the injected connection
 	_, err := pm.Connect()
@@ -43,7 +49,7 @@ func TestGetMPSInstance_NoRows(t *testing.T) {
 	pm.connection = db
 
 	guid := "22222222-2222-2222-2222-222222222222"
-	mock.ExpectQuery(`SELECT guid, mpsinstance FROM devices WHERE guid = \$1;`).WithArgs(guid).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(guid).WillReturnError(sql.ErrNoRows)
 
 	got, err := pm.GetMPSInstance(pm.connection, guid)
 	assert.NoError(t, err)
@@ -58,7 +64,7 @@ func TestGetMPSInstance_QueryError(t *testing.T) {
 	pm.connection = db
 
 	guid := "33333333-3333-3333-3333-333333333333"
-	mock.ExpectQuery(`SELECT guid, mpsinstance FROM devices WHERE guid = \$1;`).WithArgs(guid).WillReturnError(assert.AnError)
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(guid).WillReturnError(assert.AnError)
 
 	got, err := pm.GetMPSInstance(pm.connection, guid)
 	assert.Error(t, err)
@@ -72,10 +78,14 @@ func TestHealth_Success(t *testing.T) {
 	defer func() { _ = db.Close() }()
 	pm.connection = db
 
-	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectQuery("SHOW server_version").WillReturnRows(sqlmock.NewRows([]string{"server_version"}).AddRow("16.4"))
 
-	ok := pm.Health()
-	assert.True(t, ok)
+	report := pm.Health(context.Background())
+	assert.True(t, report.Reachable)
+	assert.Equal(t, "postgres", report.Backend)
+	assert.Equal(t, "16.4", report.Version)
+	assert.Empty(t, report.Error)
+	assert.NotNil(t, report.Pool)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -86,7 +96,7 @@ func TestQuery_ErrorPath(t *testing.T) {
 	pm.connection = db
 
 	guid := "44444444-4444-4444-4444-444444444444"
-	mock.ExpectQuery(`SELECT guid, mpsinstance FROM devices WHERE guid = \$1;`).WithArgs(guid).WillReturnError(assert.AnError)
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(guid).WillReturnError(assert.AnError)
 
 	got := pm.Query(guid)
 	assert.Equal(t, "", got)
@@ -99,10 +109,11 @@ func TestHealth_QueryError(t *testing.T) {
 	defer func() { _ = db.Close() }()
 	pm.connection = db
 
-	mock.ExpectQuery("SELECT 1").WillReturnError(assert.AnError)
+	mock.ExpectQuery("SHOW server_version").WillReturnError(assert.AnError)
 
-	ok := pm.Health()
-	assert.False(t, ok)
+	report := pm.Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.Equal(t, assert.AnError.Error(), report.Error)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -114,9 +125,138 @@ func TestQuery_Success(t *testing.T) {
 
 	guid := "55555555-5555-5555-5555-555555555555"
 	rows := sqlmock.NewRows([]string{"guid", "mpsinstance"}).AddRow(guid, "mps-instance-2")
-	mock.ExpectQuery(`SELECT guid, mpsinstance FROM devices WHERE guid = \$1;`).WithArgs(guid).WillReturnRows(rows)
+	mock.ExpectQuery(postgresDeviceQuery).WithArgs(guid).WillReturnRows(rows)
 
 	got := pm.Query(guid)
 	assert.Equal(t, "mps-instance-2", got)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestPostgresClose(t *testing.T) {
+	pm := &PostgresManager{}
+	assert.NoError(t, pm.Close(), "nothing to close")
+	db, mock := newSQLMock(t)
+	pm.connection = db
+	mock.ExpectClose()
+
+	assert.NoError(t, Close(pm))
+	assert.Nil(t, pm.connection)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresCustomNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		pm    *PostgresManager
+		query string
+		args  []driver.Value
+	}{
+		{
+			name:  "Defaults",
+			pm:    &PostgresManager{},
+			query: `SELECT "guid", "mpsinstance" FROM "devices" WHERE "guid" = $1;`,
+			args:  []driver.Value{lookupGUID},
+		},
+		{
+			name:  "Schema And Table",
+			pm:    &PostgresManager{Schema: "mps", Table: "Devices"},
+			query: `SELECT "guid", "mpsinstance" FROM "mps"."Devices" WHERE "guid" = $1;`,
+			args:  []driver.Value{lookupGUID},
+		},
+		{
+			name:  "Columns",
+			pm:    &PostgresManager{GUIDColumn: "device_id", InstanceColumn: "mps host"},
+			query: `SELECT "device_id", "mps host" FROM "devices" WHERE "device_id" = $1;`,
+			args:  []driver.Value{lookupGUID},
+		},
+		{
+			name:  "Tenant",
+			pm:    &PostgresManager{TenantColumn: "tenantid", Tenant: "acme"},
+			query: `SELECT "guid", "mpsinstance" FROM "devices" WHERE "guid" = $1 AND "tenantid" = $2;`,
+			args:  []driver.Value{lookupGUID, "acme"},
+		},
+		{
+			name:  "Quotes",
+			pm:    &PostgresManager{Table: `dev"ices`},
+			query: `SELECT "guid", "mpsinstance" FROM "dev""ices" WHERE "guid" = $1;`,
+			args:  []driver.Value{lookupGUID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer func() { _ = db.Close() }()
+			pm := tt.pm
+			pm.connection = db
+			mock.ExpectQuery(tt.query).WithArgs(tt.args...).
+				WillReturnRows(sqlmock.NewRows([]string{"guid", "mpsinstance"}).AddRow(lookupGUID, "mps-a"))
+
+			route, err := pm.Lookup(context.Background(), lookupGUID)
+			assert.NoError(t, err)
+			assert.Equal(t, "mps-a", route.MPSInstance)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgresInvalidNames(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		pm   *PostgresManager
+	}{
+		{"Long Table", "MPS_POSTGRES_TABLE", &PostgresManager{Table: strings.Repeat("d", 64)}},
+		{"Control Character", "MPS_POSTGRES_GUID_COLUMN", &PostgresManager{GUIDColumn: "guid\n; DROP TABLE devices"}},
+		{"Spaces", "MPS_POSTGRES_SCHEMA", &PostgresManager{Schema: " mps"}},
+		{"Invalid UTF-8", "MPS_POSTGRES_INSTANCE_COLUMN", &PostgresManager{InstanceColumn: "mps\xff"}},
+		{"Tenant Column Without Tenant", "MPS_POSTGRES_TENANT_COLUMN", &PostgresManager{TenantColumn: "tenantid"}},
+		{"Tenant Without Column", "MPS_POSTGRES_TENANT", &PostgresManager{Tenant: "acme"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+			defer func() { _ = db.Close() }()
+			pm := tt.pm
+			pm.connection = db
+
+			_, err := pm.Lookup(context.Background(), lookupGUID)
+			assert.ErrorIs(t, err, ErrUnavailable)
+			_, err = pm.GetMPSInstance(db, lookupGUID)
+			assert.Error(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet(), "nothing is sent to the database")
+
+			// and the connection string is rejected at startup
+			value := tt.pm.Schema + tt.pm.Table + tt.pm.GUIDColumn + tt.pm.InstanceColumn + tt.pm.TenantColumn + tt.pm.Tenant
+			t.Setenv(tt.env, value)
+			_, err = New("postgres://localhost/mpsdb")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewPostgresManager(t *testing.T) {
+	t.Setenv("MPS_POSTGRES_SCHEMA", "mps")
+	t.Setenv("MPS_POSTGRES_TABLE", "device")
+	t.Setenv("MPS_POSTGRES_GUID_COLUMN", "id")
+	t.Setenv("MPS_POSTGRES_INSTANCE_COLUMN", "instance")
+	t.Setenv("MPS_POSTGRES_TENANT_COLUMN", "tenantid")
+	t.Setenv("MPS_POSTGRES_TENANT", "acme")
+	assert.Equal(t, &PostgresManager{
+		ConnectionString: "postgres://localhost/mpsdb",
+		Schema:           "mps",
+		Table:            "device",
+		GUIDColumn:       "id",
+		InstanceColumn:   "instance",
+		TenantColumn:     "tenantid",
+		Tenant:           "acme",
+	}, NewPostgresManager("postgres://localhost/mpsdb"))
+
+	m, err := New("postgres://localhost/mpsdb")
+	assert.NoError(t, err)
+	query, err := m.(*PostgresManager).deviceQuery()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT "id", "instance" FROM "mps"."device" WHERE "id" = $1 AND "tenantid" = $2;`, query)
+}
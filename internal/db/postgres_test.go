@@ -5,9 +5,11 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,6 +38,28 @@ func TestConnectionPoolConfigurationInvalid(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPostgresConnectConcurrent(t *testing.T) {
+	pm := NewPostgresManager("postgresql://localhost/mps")
+	defer func() { _ = pm.Close() }()
+	dbs := make(chan Database, 20)
+	var wg sync.WaitGroup
+	for range cap(dbs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := pm.Connect()
+			assert.NoError(t, err)
+			dbs <- db
+		}()
+	}
+	wg.Wait()
+	close(dbs)
+	first := <-dbs
+	for db := range dbs {
+		assert.Same(t, first, db, "every caller shares one pool")
+	}
+}
+
 func TestGetMPSInstancewithGUID(t *testing.T) {
 	pm := PostgresManager{}
 
@@ -71,8 +95,8 @@ func TestQuery(t *testing.T) {
 
 func TestHealth(t *testing.T) {
 	pm := PostgresManager{}
-	result := pm.Health()
-	assert.Equal(t, false, result)
+	report := pm.Health(context.Background())
+	assert.Equal(t, false, report.Reachable)
 }
 
 func TestGetMPSInstance_InvalidDatabaseType(t *testing.T) {
@@ -0,0 +1,245 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisKeyPattern is the default key under which a device's MPS
+// instance is published
+const DefaultRedisKeyPattern = "mps:device:{guid}"
+
+// RedisManager reads the MPS instance of devices from Redis, where it is
+// published under a key per device, either as a string or as a field of a
+// hash.
+type RedisManager struct {
+	// ConnectionString is a redis:// or rediss:// URL
+	ConnectionString string
+	// KeyPattern is the key of a device, with {guid} replaced by its GUID.
+	// Default is "mps:device:{guid}"
+	KeyPattern string
+	// Field is the hash field holding the MPS instance, empty when the key is
+	// a string
+	Field string
+	// CAFile is a PEM file of the certificate authorities trusted for TLS,
+	// empty for the system roots
+	CAFile string
+
+	// mu guards client, which is created on first use and shared by all callers
+	mu     sync.Mutex
+	client *redis.Client
+}
+
+// NewRedisManager returns a manager for the Redis server at connectionString.
+// The key pattern, hash field and CA file are read from MPS_REDIS_KEY_PATTERN,
+// MPS_REDIS_FIELD and MPS_REDIS_CA_FILE.
+func NewRedisManager(connectionString string) *RedisManager {
+	keyPattern := os.Getenv("MPS_REDIS_KEY_PATTERN")
+	if keyPattern == "" {
+		keyPattern = DefaultRedisKeyPattern
+	}
+	return &RedisManager{
+		ConnectionString: connectionString,
+		KeyPattern:       keyPattern,
+		Field:            os.Getenv("MPS_REDIS_FIELD"),
+		CAFile:           os.Getenv("MPS_REDIS_CA_FILE"),
+	}
+}
+
+// Connect returns the manager's client, creating it on first use. The client
+// keeps its own connection pool and is safe to share across goroutines. The
+// pool is sized by MPS_DB_MAX_OPEN_CONNS and MPS_DB_MIN_POOL_SIZE, and
+// MPS_DB_CONNECT_TIMEOUT bounds dialing the server.
+func (r *RedisManager) Connect() (Database, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	opts, err := r.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Creating database client")
+	r.client = redis.NewClient(opts)
+	return r.client, nil
+}
+
+// clientOptions builds the client options from the connection string and
+// the pool settings in the environment
+func (r *RedisManager) clientOptions() (*redis.Options, error) {
+	opts, err := redis.ParseURL(r.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := os.LookupEnv("MPS_DB_MAX_OPEN_CONNS"); ok {
+		if opts.PoolSize, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := os.LookupEnv("MPS_DB_MIN_POOL_SIZE"); ok {
+		if opts.MinIdleConns, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := os.LookupEnv("MPS_DB_CONNECT_TIMEOUT"); ok {
+		if opts.DialTimeout, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	if r.CAFile != "" {
+		if opts.TLSConfig == nil {
+			return nil, errors.New("a CA file requires a rediss:// connection string")
+		}
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.CAFile)
+		}
+		opts.TLSConfig.RootCAs = roots
+		opts.TLSConfig.MinVersion = tls.VersionTLS12
+	}
+	return opts, nil
+}
+
+// Close closes the client, if one was created. The next call to Connect
+// creates a new one.
+func (r *RedisManager) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+func (r *RedisManager) GetMPSInstance(db Database, guid string) (string, error) {
+	client, ok := db.(*redis.Client)
+	if !ok {
+		return "", errors.New("invalid database type for Redis")
+	}
+	if client == nil {
+		return "", errors.New("invalid db connection")
+	}
+	instance, err := r.get(context.Background(), client, guid)
+	switch {
+	case errors.Is(err, redis.Nil):
+		log.Println("no key was found!")
+		return "", nil
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return "", err
+	}
+	return instance, nil
+}
+
+// Lookup returns the route of the device with guid, cancelling the query when
+// ctx is done
+func (r *RedisManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	client, err := r.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return Route{}, lookupError(ctx, err)
+	}
+	instance, err := r.get(ctx, client.(*redis.Client), guid)
+	switch {
+	case errors.Is(err, redis.Nil):
+		return Route{}, ErrNotFound
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, instance)
+}
+
+// get reads the MPS instance of guid, failing with redis.Nil if there is
+// none. The query is bounded by MPS_DB_QUERY_TIMEOUT.
+func (r *RedisManager) get(ctx context.Context, client *redis.Client, guid string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout())
+	defer cancel()
+	key := strings.ReplaceAll(r.KeyPattern, "{guid}", guid)
+	if r.Field != "" {
+		return client.HGet(ctx, key, r.Field).Result()
+	}
+	return client.Get(ctx, key).Result()
+}
+
+// Health reports whether the server answers a PING, along with its version
+// and the state of the connection pool
+func (r *RedisManager) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Backend: "redis"}
+	db, err := r.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+
+	client := db.(*redis.Client)
+	start := time.Now()
+	err = client.Ping(ctx).Err()
+	report.Latency = time.Since(start)
+	stats := client.PoolStats()
+	report.Pool = &PoolStats{
+		MaxOpen: client.Options().PoolSize,
+		Open:    int(stats.TotalConns),
+		InUse:   int(stats.TotalConns - stats.IdleConns),
+		Idle:    int(stats.IdleConns),
+	}
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	report.Reachable = true
+	if info, err := client.Info(ctx, "server").Result(); err == nil {
+		report.Version = infoField(info, "redis_version")
+	}
+	return report
+}
+
+// infoField returns the value of a field of an INFO reply
+func infoField(info, name string) string {
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+":"); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func (r *RedisManager) Query(guid string) string {
+	client, err := r.Connect()
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	instance, err := r.GetMPSInstance(client, guid)
+	if err != nil {
+		return ""
+	}
+	return instance
+}
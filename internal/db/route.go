@@ -0,0 +1,81 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound means no MPS instance is recorded for the device
+	ErrNotFound = errors.New("device not found")
+	// ErrUnavailable means the database could not answer the lookup
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// Route is where requests for a device are sent
+type Route struct {
+	// GUID of the device
+	GUID string
+	// MPSInstance is the MPS instance the device is connected to
+	MPSInstance string
+}
+
+// RouteManager is a Manager whose lookups can be cancelled and tell why they
+// failed.
+type RouteManager interface {
+	Manager
+
+	// Lookup returns the route of the device with the given GUID. It fails with
+	// ErrNotFound when the device has no MPS instance, with an error wrapping
+	// ErrUnavailable when the database fails, and with ctx.Err() when ctx is
+	// done first.
+	Lookup(ctx context.Context, guid string) (Route, error)
+}
+
+// Adapt returns m as a RouteManager. Managers that only implement Query are
+// wrapped so that an empty result becomes ErrNotFound; their queries cannot be
+// cancelled and keep running in the background after ctx is done.
+func Adapt(m Manager) RouteManager {
+	if rm, ok := m.(RouteManager); ok {
+		return rm
+	}
+	return queryAdapter{m}
+}
+
+// queryAdapter implements Lookup on top of Query
+type queryAdapter struct {
+	Manager
+}
+
+func (a queryAdapter) Lookup(ctx context.Context, guid string) (Route, error) {
+	result := make(chan string, 1)
+	go func() { result <- a.Query(guid) }()
+	select {
+	case instance := <-result:
+		return newRoute(guid, instance)
+	case <-ctx.Done():
+		return Route{}, ctx.Err()
+	}
+}
+
+// newRoute returns the route to instance, or ErrNotFound if it is empty
+func newRoute(guid, instance string) (Route, error) {
+	if instance == "" {
+		return Route{}, ErrNotFound
+	}
+	return Route{GUID: guid, MPSInstance: instance}, nil
+}
+
+// lookupError classifies err, returned by a lookup run with ctx: errors
+// caused by ctx are returned as is, others wrap ErrUnavailable
+func lookupError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
@@ -0,0 +1,187 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sqlDeviceQuery reads a device from the devices table, which has the same
+// schema as in PostgreSQL
+const sqlDeviceQuery = "SELECT guid, mpsinstance FROM devices WHERE guid = ?"
+
+// sqlDeviceManager reads the MPS instance of devices from the devices table of
+// a database/sql database. The backends built on it differ only in driver, data
+// source name and the query returning the version of the server.
+type sqlDeviceManager struct {
+	// backend names the database in errors and health reports
+	backend    string
+	driverName string
+	// dataSourceName returns the name of the database opened by the driver
+	dataSourceName func() (string, error)
+	// versionQuery returns the version of the server
+	versionQuery string
+
+	// mu guards connection, which is created on first use and shared by all
+	// callers
+	mu         sync.Mutex
+	connection *sql.DB
+}
+
+// openPool opens a connection pool for driverName, sized by
+// MPS_DB_MAX_OPEN_CONNS
+func openPool(driverName, dataSourceName string) (*sql.DB, error) {
+	log.Println("Creating database connection pool")
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxOpenConnsStr, ok := os.LookupEnv("MPS_DB_MAX_OPEN_CONNS"); ok {
+		maxOpenConns, err := strconv.Atoi(maxOpenConnsStr)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+	return db, nil
+}
+
+// sqlHealth reports whether client answers versionQuery, which returns the
+// version of the server, along with the state of the connection pool
+func sqlHealth(ctx context.Context, backend string, client *sql.DB, versionQuery string) HealthReport {
+	report := HealthReport{Backend: backend}
+	start := time.Now()
+	err := client.QueryRowContext(ctx, versionQuery).Scan(&report.Version)
+	report.Latency = time.Since(start)
+	stats := client.Stats()
+	report.Pool = &PoolStats{
+		MaxOpen: stats.MaxOpenConnections,
+		Open:    stats.OpenConnections,
+		InUse:   stats.InUse,
+		Idle:    stats.Idle,
+	}
+	if err != nil {
+		log.Println(err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	report.Reachable = true
+	return report
+}
+
+func (m *sqlDeviceManager) Connect() (Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connection != nil {
+		return m.connection, nil
+	}
+
+	dsn, err := m.dataSourceName()
+	if err != nil {
+		return nil, err
+	}
+	db, err := openPool(m.driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	m.connection = db
+
+	return db, nil
+}
+
+// Close closes the connection pool, if one was created
+func (m *sqlDeviceManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connection == nil {
+		return nil
+	}
+	err := m.connection.Close()
+	m.connection = nil
+	return err
+}
+
+func (m *sqlDeviceManager) GetMPSInstance(db Database, guid string) (string, error) {
+	client, ok := db.(*sql.DB)
+	if !ok {
+		return "", errors.New("invalid database type for " + m.backend)
+	}
+	if client == nil {
+		return "", errors.New("invalid db connection")
+	}
+	device, err := m.findDevice(context.Background(), client, guid)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.Println("no rows were returned!")
+		return "", nil
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return "", err
+	}
+	return device.MPSinstance, nil
+}
+
+// Lookup returns the route of the device with guid, cancelling the query when
+// ctx is done
+func (m *sqlDeviceManager) Lookup(ctx context.Context, guid string) (Route, error) {
+	db, err := m.Connect()
+	if err != nil {
+		log.Println("Failed to open a DB connection: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	device, err := m.findDevice(ctx, db.(*sql.DB), guid)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Route{}, ErrNotFound
+	case err != nil:
+		log.Println("failed to execute query: ", err)
+		return Route{}, lookupError(ctx, err)
+	}
+	return newRoute(guid, device.MPSinstance)
+}
+
+// findDevice reads the device with guid, failing with sql.ErrNoRows if there
+// is none
+func (m *sqlDeviceManager) findDevice(ctx context.Context, client *sql.DB, guid string) (Device, error) {
+	var device Device
+	row := client.QueryRowContext(ctx, sqlDeviceQuery, guid)
+	err := row.Scan(&device.GUID, &device.MPSinstance)
+	return device, err
+}
+
+// Health reports whether the database answers a query, along with its
+// version and the state of the connection pool
+func (m *sqlDeviceManager) Health(ctx context.Context) HealthReport {
+	db, err := m.Connect()
+	if err != nil {
+		log.Println("Failed to open a DB connection: ", err)
+		return HealthReport{Backend: m.backend, Error: err.Error()}
+	}
+	return sqlHealth(ctx, m.backend, db.(*sql.DB), m.versionQuery)
+}
+
+func (m *sqlDeviceManager) Query(guid string) string {
+	db, err := m.Connect()
+	if err != nil {
+		log.Println("Failed to open a DB connection: ", err)
+		return ""
+	}
+	instance, err := m.GetMPSInstance(db, guid)
+	if err != nil {
+		return ""
+	}
+	return instance
+}
@@ -0,0 +1,55 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBusyTimeout is how long, in milliseconds, a query waits for another
+// process writing the database
+const sqliteBusyTimeout = "5000"
+
+// SQLiteManager reads the MPS instance of devices from the devices table of a
+// SQLite database file, which has the same schema as in PostgreSQL. The
+// driver is written in Go, so the router still builds without cgo. The file is
+// opened read-only and must already exist.
+type SQLiteManager struct {
+	// Path of the database file
+	Path string
+
+	sqlDeviceManager
+}
+
+// NewSQLiteManager returns a manager for the database file named by a
+// sqlite:// connection string, relative to the working directory unless it
+// starts with a slash as in sqlite:///var/lib/mps/devices.db
+func NewSQLiteManager(connectionString string) *SQLiteManager {
+	s := &SQLiteManager{
+		Path: strings.TrimPrefix(connectionString, "sqlite://"),
+	}
+	s.backend = "sqlite"
+	s.driverName = "sqlite"
+	s.dataSourceName = func() (string, error) {
+		if s.Path == "" {
+			return "", errors.New("SQLite connection string names no file")
+		}
+		return s.fileURI(), nil
+	}
+	s.versionQuery = "SELECT sqlite_version()"
+	return s
+}
+
+// fileURI returns the URI opening the database file read-only
+func (s *SQLiteManager) fileURI() string {
+	query := url.Values{}
+	query.Set("mode", "ro")
+	query.Set("_pragma", "busy_timeout("+sqliteBusyTimeout+")")
+	return "file:" + (&url.URL{Path: s.Path}).EscapedPath() + "?" + query.Encode()
+}
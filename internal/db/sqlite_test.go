@@ -0,0 +1,169 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createSQLiteDB creates a database file in a temporary directory, running
+// statements in it, and returns its path
+func createSQLiteDB(t *testing.T, statements ...string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "mps.db")
+	db, err := sql.Open("sqlite", p)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("failed to run %q: %v", statement, err)
+		}
+	}
+	return p
+}
+
+const sqliteSchema = "CREATE TABLE devices (guid TEXT PRIMARY KEY, mpsinstance TEXT NOT NULL)"
+
+// newTestSQLiteManager returns a manager for the database file at p
+func newTestSQLiteManager(t *testing.T, p string) *SQLiteManager {
+	t.Helper()
+	s := NewSQLiteManager("sqlite://" + p)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestSQLiteLookup(t *testing.T) {
+	for _, c := range lookupCases {
+		t.Run(c.name, func(t *testing.T) {
+			var p string
+			switch {
+			case c.fail:
+				p = createSQLiteDB(t, "CREATE TABLE other (id INTEGER)")
+			case c.stored:
+				p = createSQLiteDB(t, sqliteSchema, "INSERT INTO devices VALUES ('"+lookupGUID+"', '"+c.instance+"')")
+			default:
+				p = createSQLiteDB(t, sqliteSchema)
+			}
+			s := newTestSQLiteManager(t, p)
+			db, err := s.Connect()
+			assert.NoError(t, err)
+			checkLookup(t, c, s, db)
+		})
+	}
+}
+
+func TestSQLiteReadOnly(t *testing.T) {
+	p := createSQLiteDB(t, sqliteSchema, "INSERT INTO devices VALUES ('guid-a', 'mps-a')")
+	s := newTestSQLiteManager(t, p)
+	db, err := s.Connect()
+	assert.NoError(t, err)
+	_, err = db.(*sql.DB).Exec("DELETE FROM devices")
+	assert.Error(t, err, "the database is opened read-only")
+	assert.Equal(t, "mps-a", s.Query("guid-a"))
+
+	// a missing file is not created
+	missing := newTestSQLiteManager(t, filepath.Join(t.TempDir(), "missing.db"))
+	_, err = missing.Lookup(context.Background(), "guid-a")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.NoFileExists(t, missing.Path)
+}
+
+func TestSQLiteSeesWrites(t *testing.T) {
+	p := createSQLiteDB(t, sqliteSchema)
+	s := newTestSQLiteManager(t, p)
+	assert.Equal(t, "", s.Query("guid-a"))
+
+	writer, err := sql.Open("sqlite", p)
+	assert.NoError(t, err)
+	defer func() { _ = writer.Close() }()
+	_, err = writer.Exec("INSERT INTO devices VALUES ('guid-a', 'mps-a')")
+	assert.NoError(t, err)
+	assert.Equal(t, "mps-a", s.Query("guid-a"))
+}
+
+func TestSQLiteHealth(t *testing.T) {
+	s := newTestSQLiteManager(t, createSQLiteDB(t, sqliteSchema))
+	report := s.Health(context.Background())
+	assert.True(t, report.Reachable)
+	assert.Equal(t, "sqlite", report.Backend)
+	assert.NotEmpty(t, report.Version)
+	assert.NotNil(t, report.Pool)
+
+	report = newTestSQLiteManager(t, filepath.Join(t.TempDir(), "missing.db")).Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.NotEmpty(t, report.Error)
+
+	report = NewSQLiteManager("sqlite://").Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.NotEmpty(t, report.Error)
+}
+
+func TestSQLiteConnectionPoolConfiguration(t *testing.T) {
+	p := createSQLiteDB(t, sqliteSchema)
+	t.Setenv("MPS_DB_MAX_OPEN_CONNS", "3")
+	s := newTestSQLiteManager(t, p)
+	_, err := s.Connect()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.connection.Stats().MaxOpenConnections)
+
+	t.Setenv("MPS_DB_MAX_OPEN_CONNS", "not-a-number")
+	_, err = newTestSQLiteManager(t, p).Connect()
+	assert.Error(t, err)
+}
+
+func TestSQLiteClose(t *testing.T) {
+	s := newTestSQLiteManager(t, createSQLiteDB(t, sqliteSchema))
+	assert.NoError(t, s.Close(), "nothing to close")
+	first, err := s.Connect()
+	assert.NoError(t, err)
+	assert.NoError(t, Close(s))
+	assert.Nil(t, s.connection)
+	second, err := s.Connect()
+	assert.NoError(t, err)
+	assert.NotSame(t, first, second)
+}
+
+func TestSQLiteLookupConcurrent(t *testing.T) {
+	s := newTestSQLiteManager(t, createSQLiteDB(t, sqliteSchema, "INSERT INTO devices VALUES ('guid-a', 'mps-a')"))
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			route, err := s.Lookup(context.Background(), "guid-a")
+			assert.NoError(t, err)
+			assert.Equal(t, "mps-a", route.MPSInstance)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSQLiteGetMPSInstanceInvalidDatabase(t *testing.T) {
+	s := NewSQLiteManager("sqlite://mps.db")
+	_, err := s.GetMPSInstance(&PostgresManager{}, lookupGUID)
+	assert.Error(t, err)
+	var db *sql.DB
+	_, err = s.GetMPSInstance(db, lookupGUID)
+	assert.Error(t, err)
+}
+
+func TestNewSQLiteManager(t *testing.T) {
+	assert.Equal(t, "/var/lib/mps/devices.db", NewSQLiteManager("sqlite:///var/lib/mps/devices.db").Path)
+	assert.Equal(t, "devices.db", NewSQLiteManager("sqlite://devices.db").Path)
+	assert.Equal(t, "file:/var/lib/mps%20data/devices.db?_pragma=busy_timeout%285000%29&mode=ro",
+		NewSQLiteManager("sqlite:///var/lib/mps data/devices.db").fileURI())
+
+	m, err := New("sqlite:///var/lib/mps/devices.db")
+	assert.NoError(t, err)
+	assert.IsType(t, &SQLiteManager{}, m)
+}
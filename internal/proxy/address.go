@@ -0,0 +1,101 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// instanceAddress returns the TCP address of the MPS instance stored for a
+// device. The instance may be a bare host, host:port, an IPv6 address with or
+// without brackets, or a URL with a scheme. When it carries no port, the port
+// of the default target is used.
+func instanceAddress(instance, target string) (string, error) {
+	host, port, err := parseInstance(instance)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		if port, err = targetPort(target); err != nil {
+			return "", fmt.Errorf("no port for MPS instance %q: %w", instance, err)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseInstance returns the validated host and port of an instance, the port
+// being empty when the instance has none
+func parseInstance(instance string) (string, string, error) {
+	instance = strings.TrimSpace(instance)
+	host, port, err := splitInstance(instance)
+	if err == nil {
+		err = validateHost(host)
+	}
+	if err == nil && port != "" {
+		err = validatePort(port)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("invalid MPS instance %q: %w", instance, err)
+	}
+	return host, port, nil
+}
+
+// splitInstance splits an instance into its host and port, the port being
+// empty when the instance has none
+func splitInstance(instance string) (string, string, error) {
+	if strings.Contains(instance, "://") {
+		u, err := url.Parse(instance)
+		if err != nil {
+			return "", "", err
+		}
+		return u.Hostname(), u.Port(), nil
+	}
+	if host, port, err := net.SplitHostPort(instance); err == nil {
+		return host, port, nil
+	}
+	// a bracketed IPv6 address without a port
+	if strings.HasPrefix(instance, "[") && strings.HasSuffix(instance, "]") {
+		return instance[1 : len(instance)-1], "", nil
+	}
+	// an unbracketed IPv6 address cannot carry a port
+	if strings.Contains(instance, ":") && net.ParseIP(instance) == nil {
+		return "", "", fmt.Errorf("malformed host:port")
+	}
+	return instance, "", nil
+}
+
+// validateHost rejects empty hosts and characters that cannot appear in a
+// hostname or IP address
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if strings.ContainsAny(host, " /?#@[]") {
+		return fmt.Errorf("malformed host %q", host)
+	}
+	return nil
+}
+
+// validatePort rejects ports that are not numbers between 1 and 65535
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("malformed port %q", port)
+	}
+	return nil
+}
+
+// targetPort returns the port of the default target address
+func targetPort(target string) (string, error) {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	return port, validatePort(port)
+}
@@ -0,0 +1,79 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		target   string
+		want     string
+		wantErr  bool
+	}{
+		{"Bare Host", "mps-1", "mps:3000", "mps-1:3000", false},
+		{"Bare Host With Spaces", " mps-1 ", "mps:3000", "mps-1:3000", false},
+		{"Host And Port", "mps-1:4433", "mps:3000", "mps-1:4433", false},
+		{"IPv4", "10.0.0.5", "mps:3000", "10.0.0.5:3000", false},
+		{"IPv6", "fd00::5", "mps:3000", "[fd00::5]:3000", false},
+		{"Bracketed IPv6", "[fd00::5]", "mps:3000", "[fd00::5]:3000", false},
+		{"Bracketed IPv6 And Port", "[fd00::5]:4433", "mps:3000", "[fd00::5]:4433", false},
+		{"IPv6 Target", "mps-1", "[fd00::1]:3000", "mps-1:3000", false},
+		{"URL", "http://mps-1:4433", "mps:3000", "mps-1:4433", false},
+		{"URL Without Port", "https://mps-1/api", "mps:3000", "mps-1:3000", false},
+		{"IPv6 URL", "http://[fd00::5]:4433/", "mps:3000", "[fd00::5]:4433", false},
+		{"Port From Instance Without Target Port", "mps-1:4433", "mps", "mps-1:4433", false},
+		{"No Port Anywhere", "mps-1", "mps", "", true},
+		{"Bad Port", "mps-1:http", "mps:3000", "", true},
+		{"Port Out Of Range", "mps-1:70000", "mps:3000", "", true},
+		{"Missing Host", ":3000", "mps:3000", "", true},
+		{"URL Missing Host", "http://:3000", "mps:3000", "", true},
+		{"Malformed URL", "http://mps-1:port", "mps:3000", "", true},
+		{"Too Many Colons", "mps-1:3000:1", "mps:3000", "", true},
+		{"Path Without Scheme", "mps-1/api", "mps:3000", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := instanceAddress(tt.instance, tt.target)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	head := []byte("GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n")
+	tests := []struct {
+		name     string
+		instance string
+		target   string
+		want     []string
+		wantErr  error
+	}{
+		{"Default Target", "", "mps:3000", []string{"mps:3000"}, nil},
+		{"Default Target Without Port", "", "mps", []string{"mps"}, nil},
+		{"Instance", "[fd00::5]:4433", "mps:3000", []string{"[fd00::5]:4433"}, nil},
+		{"Invalid Instance", "mps-1:http", "mps:3000", nil, errInvalidInstance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(&test.MockSQLDBManager{QueryResult: tt.instance}, "", tt.target)
+			got, err := srv.destinations(context.Background(), head)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
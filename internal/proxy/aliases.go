@@ -0,0 +1,201 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultAliasPollInterval is how often Watch checks the alias file for changes
+const DefaultAliasPollInterval = 5 * time.Second
+
+// Aliases maps the MPS instance names stored in the database to the addresses
+// they are served on, so an instance can move without rewriting the devices
+// table. The map is read from a YAML or JSON file of the form
+//
+//	mps-0: 10.0.0.5:3000
+//	mps-1:
+//	  - 10.0.1.5:3000
+//	  - 10.0.1.6:3000
+//
+// where each address takes any form accepted for an instance and is tried in
+// order until one accepts a connection. Aliases is safe for concurrent use.
+type Aliases struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string][]string
+	// Modification time and size of the file when it was last loaded
+	modTime time.Time
+	size    int64
+	// Functions called after each successful reload
+	onReload []func()
+}
+
+// aliasAddrs is the list of addresses of an alias, which may be written as a
+// single string
+type aliasAddrs []string
+
+func (a *aliasAddrs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*a = aliasAddrs{value.Value}
+		return nil
+	}
+	var addrs []string
+	if err := value.Decode(&addrs); err != nil {
+		return err
+	}
+	*a = addrs
+	return nil
+}
+
+// LoadAliases reads the alias map at path
+func LoadAliases(path string) (*Aliases, error) {
+	a := &Aliases{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the alias file again. The current map is kept if the file
+// cannot be read or is invalid.
+func (a *Aliases) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.path)
+	var entries map[string][]string
+	if err == nil {
+		if entries, err = parseAliases(data); err != nil {
+			err = fmt.Errorf("alias file %s: %w", a.path, err)
+		}
+	}
+	a.mu.Lock()
+	// an invalid file is not read again until it changes
+	a.modTime, a.size = info.ModTime(), info.Size()
+	if err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	a.entries = entries
+	onReload := a.onReload
+	a.mu.Unlock()
+	for _, f := range onReload {
+		f()
+	}
+	return nil
+}
+
+// OnReload registers f to be called after each successful reload
+func (a *Aliases) OnReload(f func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onReload = append(a.onReload, f)
+}
+
+// parseAliases decodes and validates the contents of an alias file. JSON is
+// accepted since it is valid YAML.
+func parseAliases(data []byte) (map[string][]string, error) {
+	var raw map[string]aliasAddrs
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]string, len(raw))
+	for alias, addrs := range raw {
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("alias %q has no addresses", alias)
+		}
+		for _, addr := range addrs {
+			if _, _, err := parseInstance(addr); err != nil {
+				return nil, fmt.Errorf("alias %q: %w", alias, err)
+			}
+		}
+		entries[alias] = addrs
+	}
+	return entries, nil
+}
+
+// Lookup returns the addresses of instance, or nil when it is not an alias.
+// A nil *Aliases has no aliases.
+func (a *Aliases) Lookup(instance string) []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.entries[instance]
+}
+
+// Instances returns the addresses of every alias, each once and in no
+// particular order. A nil *Aliases has none.
+func (a *Aliases) Instances() []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	seen := map[string]bool{}
+	var instances []string
+	for _, addrs := range a.entries {
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				instances = append(instances, addr)
+			}
+		}
+	}
+	return instances
+}
+
+// Watch reloads the alias file whenever a value arrives on reload, such as
+// SIGHUP, or the file changes on disk, until ctx is done. Errors are logged
+// and the previous map stays in use.
+func (a *Aliases) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	if interval <= 0 {
+		interval = DefaultAliasPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			a.reloadAndLog()
+		case <-ticker.C:
+			if a.changed() {
+				a.reloadAndLog()
+			}
+		}
+	}
+}
+
+// changed reports whether the alias file differs from the one last loaded
+func (a *Aliases) changed() bool {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return !info.ModTime().Equal(a.modTime) || info.Size() != a.size
+}
+
+func (a *Aliases) reloadAndLog() {
+	if err := a.Reload(); err != nil {
+		log.Println("Error reloading aliases:", err)
+		return
+	}
+	log.Println("Reloaded aliases from", a.path)
+}
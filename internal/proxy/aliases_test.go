@@ -0,0 +1,187 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeAliases writes an alias file into a temporary directory
+func writeAliases(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write aliases: %v", err)
+	}
+	return path
+}
+
+func TestLoadAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:    "YAML",
+			file:    "aliases.yaml",
+			content: "mps-0: 10.0.0.5:3000\nmps-1:\n  - 10.0.1.5:3000\n  - \"[fd00::6]\"\n",
+			want:    map[string][]string{"mps-0": {"10.0.0.5:3000"}, "mps-1": {"10.0.1.5:3000", "[fd00::6]"}},
+		},
+		{
+			name:    "JSON",
+			file:    "aliases.json",
+			content: `{"mps-0": "http://10.0.0.5:3000", "mps-1": ["10.0.1.5", "10.0.1.6"]}`,
+			want:    map[string][]string{"mps-0": {"http://10.0.0.5:3000"}, "mps-1": {"10.0.1.5", "10.0.1.6"}},
+		},
+		{name: "Empty", file: "aliases.yaml", content: "", want: map[string][]string{}},
+		{name: "No Addresses", file: "aliases.yaml", content: "mps-0: []\n", wantErr: true},
+		{name: "Invalid Address", file: "aliases.yaml", content: "mps-0: 10.0.0.5:port\n", wantErr: true},
+		{name: "Not A Map", file: "aliases.yaml", content: "- mps-0\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := LoadAliases(writeAliases(t, tt.file, tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, a.entries)
+		})
+	}
+}
+
+func TestLoadAliasesMissingFile(t *testing.T) {
+	_, err := LoadAliases(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestAliasesReloadKeepsMapOnError(t *testing.T) {
+	path := writeAliases(t, "aliases.yaml", "mps-0: 10.0.0.5\n")
+	a, err := LoadAliases(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: [\n"), 0o600))
+	assert.Error(t, a.Reload())
+	assert.Equal(t, []string{"10.0.0.5"}, a.Lookup("mps-0"))
+	assert.False(t, a.changed(), "an invalid file is not read again until it changes")
+
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: 10.0.0.9\n"), 0o600))
+	assert.NoError(t, a.Reload())
+	assert.Equal(t, []string{"10.0.0.9"}, a.Lookup("mps-0"))
+	assert.Nil(t, a.Lookup("mps-1"))
+}
+
+func TestAliasesInstances(t *testing.T) {
+	a, err := LoadAliases(writeAliases(t, "aliases.yaml", "mps-0:\n  - 10.0.0.5\n  - 10.0.0.6:3001\nmps-1: 10.0.0.5\n"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.5", "10.0.0.6:3001"}, a.Instances())
+	var none *Aliases
+	assert.Nil(t, none.Instances())
+}
+
+func TestAliasesOnReload(t *testing.T) {
+	path := writeAliases(t, "aliases.yaml", "mps-0: 10.0.0.5\n")
+	a, err := LoadAliases(path)
+	assert.NoError(t, err)
+	reloads := 0
+	a.OnReload(func() { reloads++ })
+
+	assert.NoError(t, a.Reload())
+	assert.Equal(t, 1, reloads)
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: [\n"), 0o600))
+	assert.Error(t, a.Reload())
+	assert.Equal(t, 1, reloads, "failed reloads are not reported")
+}
+
+func TestNilAliasesLookup(t *testing.T) {
+	var a *Aliases
+	assert.Nil(t, a.Lookup("mps-0"))
+}
+
+func TestAliasesWatch(t *testing.T) {
+	path := writeAliases(t, "aliases.yaml", "mps-0: 10.0.0.5\n")
+	a, err := LoadAliases(path)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Watch(ctx, 10*time.Millisecond, reload)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// a change on disk is picked up by polling
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: 10.0.0.6:3001\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		addrs := a.Lookup("mps-0")
+		return len(addrs) == 1 && addrs[0] == "10.0.0.6:3001"
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// a signal forces a reload even when the file looks unchanged
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: 10.0.0.7:3001\n"), 0o600))
+	assert.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	reload <- syscall.SIGHUP
+	assert.Eventually(t, func() bool {
+		addrs := a.Lookup("mps-0")
+		return len(addrs) == 1 && addrs[0] == "10.0.0.7:3001"
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestAliasFailover(t *testing.T) {
+	aliases, err := LoadAliases(writeAliases(t, "aliases.yaml", "mps-0:\n  - mps-down\n  - mps-standby:3001\n"))
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{QueryResult: "mps-0"}, "", "mps:3000")
+	srv.Aliases = aliases
+	recorder := &dialRecorder{hosts: map[string]string{"mps-standby": newNamedUpstream(t, "standby")}}
+	srv.dial = recorder.dial
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	br := bufio.NewReader(client)
+
+	path := "/api/v1/amt/log/audit/" + guidA
+	assert.Equal(t, "standby "+path, roundTrip(t, client, br, "GET "+path+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	assert.Equal(t, []string{"mps-down", "mps-standby"}, recorder.hostsDialed())
+
+	// the open upstream is reused for the next request
+	assert.Equal(t, "standby "+path, roundTrip(t, client, br, "GET "+path+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	assert.Equal(t, []string{"mps-down", "mps-standby"}, recorder.hostsDialed())
+}
+
+func TestAliasAllAddressesDown(t *testing.T) {
+	aliases, err := LoadAliases(writeAliases(t, "aliases.yaml", "mps-0:\n  - "+closedAddr(t)+"\n  - "+closedAddr(t)+"\n"))
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{QueryResult: "mps-0"}, "", "mps:3000")
+	srv.Aliases = aliases
+	client, app := net.Pipe()
+	go newClientConn(srv, app).serve()
+	defer func() { _ = client.Close() }()
+	_, _ = client.Write([]byte("GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n"))
+
+	resp, _ := readErrorResponse(t, client)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "upstream_unreachable", resp.Header.Get(ErrorHeader))
+}
@@ -0,0 +1,544 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connState is a stage in the lifecycle of a proxied client connection
+type connState int
+
+const (
+	// stateAccepting means a new connection is waiting for its first request head
+	stateAccepting connState = iota
+	// stateIdle means a kept-alive connection is waiting for its next request
+	stateIdle
+	// stateRouting means the destination of a request is being looked up
+	stateRouting
+	// stateDialing means a connection to the destination is being opened
+	stateDialing
+	// stateStreaming means a request and its response, or a tunnel, are being relayed
+	stateStreaming
+	// stateClosing means the connection and its upstreams are being closed
+	stateClosing
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateAccepting:
+		return "accepting"
+	case stateIdle:
+		return "idle"
+	case stateRouting:
+		return "routing"
+	case stateDialing:
+		return "dialing"
+	case stateStreaming:
+		return "streaming"
+	case stateClosing:
+		return "closing"
+	}
+	return "unknown"
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt a blocked read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// idleCheckTimeout is how long a read waits for an idle upstream connection
+// to show it has been closed
+const idleCheckTimeout = time.Millisecond
+
+// clientConn is a proxied client connection. Each HTTP request read from it is
+// routed on its own, so a keep-alive connection can reach several MPS
+// instances. Traffic that cannot be framed as HTTP/1.x, and connections that
+// have been upgraded, are relayed verbatim to a single upstream.
+//
+// serve drives the connection through its states; every path ends in
+// stateClosing, which closes the client and all of its upstreams and waits for
+// the goroutines started on its behalf.
+type clientConn struct {
+	srv  *Server
+	conn net.Conn
+	br   *bufio.Reader
+	// Whether the server accepted the connection for tracking
+	tracked bool
+	// Whether the connection exceeded the server's MaxConns
+	overloaded bool
+	// Number of requests read from the connection
+	requests int
+
+	// Head of the request being relayed
+	head []byte
+	// Parsed request head, nil when the request cannot be framed
+	req *messageHead
+	// Addresses the request can be routed to, in order of preference
+	dests []string
+	// Address of the upstream the request is routed to
+	dest string
+	// Upstream the request is relayed to
+	up *upstreamConn
+	// Whether the request has been retried on a new upstream connection
+	retried bool
+
+	// Goroutines relaying request bodies or watching the client
+	wg sync.WaitGroup
+
+	// mu guards upstreams, which Shutdown may close from another goroutine
+	mu sync.Mutex
+	// Open upstream connections keyed by destination address
+	upstreams map[string]*upstreamConn
+}
+
+// upstreamConn is a connection to an MPS instance opened for a client
+type upstreamConn struct {
+	addr string
+	conn net.Conn
+	br   *bufio.Reader
+	// Whether a request has already been sent on this connection
+	used bool
+}
+
+// idleOpen reports whether an idle upstream connection is still open, waiting
+// at most idleCheckTimeout. An upstream that closed it, or sent anything while
+// no request was pending, cannot be used for another request.
+func (up *upstreamConn) idleOpen() bool {
+	if up.br.Buffered() > 0 {
+		return false
+	}
+	// a deadline in the past would fail the read without looking at the
+	// connection, so a close would go unnoticed
+	if err := up.conn.SetReadDeadline(time.Now().Add(idleCheckTimeout)); err != nil {
+		return false
+	}
+	_, err := up.br.Peek(1)
+	if derr := up.conn.SetReadDeadline(time.Time{}); derr != nil {
+		return false
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// newClientConn wraps conn and registers it with s, so that Shutdown can wait
+// for it to finish
+func newClientConn(s *Server, conn net.Conn) *clientConn {
+	size := s.MaxHeaderBytes
+	if size <= 0 {
+		size = DefaultMaxHeaderBytes
+	}
+	c := &clientConn{
+		srv:       s,
+		conn:      conn,
+		br:        bufio.NewReaderSize(conn, size),
+		upstreams: map[string]*upstreamConn{},
+	}
+	c.tracked = s.trackConn(c, true)
+	return c
+}
+
+// serve runs the connection state machine until the connection is closed
+func (c *clientConn) serve() {
+	defer c.srv.trackConn(c, false)
+	defer c.wg.Wait()
+	defer c.close()
+
+	state := stateAccepting
+	if !c.tracked {
+		state = stateClosing
+	}
+	for state != stateClosing {
+		c.srv.setState(c, state)
+		switch state {
+		case stateAccepting:
+			state = c.accept()
+		case stateRouting:
+			state = c.route()
+		case stateDialing:
+			state = c.dial()
+		case stateStreaming:
+			state = c.stream()
+		}
+	}
+	c.srv.setState(c, stateClosing)
+}
+
+// accept reads the next request head
+func (c *clientConn) accept() connState {
+	head, err := c.readRequest()
+	if len(head) == 0 || (err != nil && err != io.EOF) {
+		if err != nil && err != io.EOF && !isClosed(err) {
+			log.Println(err)
+		}
+		return stateClosing
+	}
+	c.head, c.req, c.up, c.retried = head, nil, nil, false
+	if err == nil {
+		if req, err := parseRequestHead(head); err == nil {
+			c.req = req
+		}
+	}
+	if c.overloaded {
+		return c.fail(errOverloaded)
+	}
+	return stateRouting
+}
+
+// readRequest reads the next request head, enforcing HeaderTimeout and
+// MaxHeaderBytes. A kept-alive connection counts as idle until the first byte
+// of its next request arrives, and is not read at all once the server is
+// shutting down.
+func (c *clientConn) readRequest() ([]byte, error) {
+	if c.srv.HeaderTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.srv.HeaderTimeout)); err != nil {
+			return nil, err
+		}
+		defer c.clearReadDeadline()
+	}
+	c.requests++
+	if c.requests > 1 && c.br.Buffered() == 0 {
+		if !c.srv.setState(c, stateIdle) {
+			return nil, nil
+		}
+		_, err := c.br.Peek(1)
+		c.srv.setState(c, stateAccepting)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxBytes := c.srv.MaxHeaderBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxHeaderBytes
+	}
+	return readHead(c.br, maxBytes)
+}
+
+// route looks up the destination of the current request, preferring an
+// upstream that is already open to any of its addresses
+func (c *clientConn) route() connState {
+	ctx, stop := c.watchClient()
+	dests, err := c.srv.destinations(ctx, c.head)
+	stop()
+	if err != nil {
+		var rerr routerError
+		if errors.As(err, &rerr) {
+			return c.fail(rerr)
+		}
+		if errors.Is(err, context.Canceled) {
+			log.Println("Client disconnected while routing", requestLine(c.head))
+		} else {
+			log.Println(err)
+		}
+		return stateClosing
+	}
+	c.dests = dests
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, dest := range c.dests {
+		if up := c.upstreams[dest]; up != nil {
+			c.dest, c.up = dest, up
+			return stateStreaming
+		}
+	}
+	return stateDialing
+}
+
+// watchClient returns a context that is cancelled if the client connection is
+// reset or closed while the request is routed. A half-closed client can still
+// receive the response, so it does not cancel the lookup. The returned function
+// stops watching; it must be called before the client connection is read
+// again.
+func (c *clientConn) watchClient() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var stopping atomic.Bool
+	done := make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(done)
+		if _, err := c.br.Peek(1); err != nil && err != io.EOF && !stopping.Load() {
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		stopping.Store(true)
+		if err := c.conn.SetReadDeadline(aLongTimeAgo); err != nil && !isClosed(err) {
+			log.Printf("Error interrupting client read: %v", err)
+		}
+		<-done
+		c.clearReadDeadline()
+		cancel()
+	}
+}
+
+// dial opens a connection to the first address of the current request that
+// accepts one
+func (c *clientConn) dial() connState {
+	for _, dest := range c.dests {
+		conn, err := c.srv.dialUpstream(dest)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		c.dest = dest
+		c.up = &upstreamConn{
+			addr: dest,
+			conn: conn,
+			br:   bufio.NewReaderSize(conn, DefaultMaxHeaderBytes),
+		}
+		c.mu.Lock()
+		c.upstreams[dest] = c.up
+		c.mu.Unlock()
+		c.srv.trackUpstream(dest, 1)
+		return stateStreaming
+	}
+	return c.fail(errUpstreamUnreachable)
+}
+
+// stream relays the current request and its response
+func (c *clientConn) stream() connState {
+	up := c.up
+	if c.req == nil {
+		// not a request we can frame, so relay the rest of the connection as is
+		if _, err := up.conn.Write(c.head); err != nil {
+			logError(err)
+			return stateClosing
+		}
+		c.tunnel(up)
+		return stateClosing
+	}
+
+	// a kept-alive upstream may have been closed while idle. That is checked
+	// before sending the request, and a request without a body can safely be
+	// sent again on a new connection should the upstream close in between.
+	if up.used && !c.retried && !up.idleOpen() {
+		return c.redial()
+	}
+	retry := up.used && c.req.body == bodyNone && !c.retried
+	up.used = true
+	if _, err := up.conn.Write(c.head); err != nil {
+		if retry {
+			return c.redial()
+		}
+		logError(err)
+		return c.fail(errUpstreamClosed)
+	}
+
+	wait := c.relayRequestBody(up)
+	// whether part of a response has been sent to the client
+	relayed := false
+	for {
+		rhead, err := readHead(up.br, up.br.Size())
+		if len(rhead) == 0 && err != nil {
+			werr := wait()
+			if retry && werr == nil {
+				return c.redial()
+			}
+			logError(err)
+			if !relayed {
+				return c.fail(errUpstreamClosed)
+			}
+			return stateClosing
+		}
+		relayed = true
+		if _, werr := c.conn.Write(rhead); werr != nil {
+			logError(werr)
+			wait()
+			return stateClosing
+		}
+		resp, perr := parseResponseHead(rhead, c.req)
+		if err != nil || perr != nil {
+			// not a response we can frame, so relay the rest of the connection as is
+			if wait() == nil {
+				c.tunnel(up)
+			}
+			return stateClosing
+		}
+		if resp.status == http.StatusSwitchingProtocols || (c.req.method == http.MethodConnect && resp.status/100 == 2) {
+			// the connection now speaks another protocol, such as WebSocket,
+			// or is a tunnel, and is pinned to this upstream
+			if wait() == nil {
+				c.tunnel(up)
+			}
+			return stateClosing
+		}
+		if resp.status >= 200 {
+			return c.finish(resp, up, wait)
+		}
+		// interim responses are followed by another response head
+		retry = false
+	}
+}
+
+// finish relays a final response body and decides whether the connection can
+// be used for another request
+func (c *clientConn) finish(resp *messageHead, up *upstreamConn, wait func() error) connState {
+	err := copyBody(c.conn, up.br, resp)
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		logError(err)
+		return stateClosing
+	}
+	if resp.body == bodyUntilClose || !resp.keepAlive() || !c.req.keepAlive() {
+		c.drop(up)
+		return stateClosing
+	}
+	return stateAccepting
+}
+
+// relayRequestBody copies the body of the current request to up in the
+// background. Requests without a body watch the client instead, so that a
+// reset is noticed while the response is pending. Either way, a failure on
+// the client side closes up to interrupt the response. The returned function
+// stops the background work, waits for it and returns its error; it must be
+// called before the client connection is read again.
+func (c *clientConn) relayRequestBody(up *upstreamConn) func() error {
+	var stopping atomic.Bool
+	done := make(chan error, 1)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		var err error
+		if c.req.body == bodyNone {
+			_, err = c.br.Peek(1)
+			if err == io.EOF || stopping.Load() {
+				// a half-closed client can still receive the response
+				err = nil
+			}
+		} else {
+			err = copyBody(up.conn, c.br, c.req)
+		}
+		if err != nil {
+			closeConn(up.conn)
+		}
+		done <- err
+	}()
+
+	return func() error {
+		if c.req.body == bodyNone {
+			stopping.Store(true)
+			if err := c.conn.SetReadDeadline(aLongTimeAgo); err != nil && !isClosed(err) {
+				log.Printf("Error interrupting client read: %v", err)
+			}
+			defer c.clearReadDeadline()
+		}
+		return <-done
+	}
+}
+
+// fail answers the current request with a router error, provided it could be
+// framed as HTTP, and closes the connection. It must only be used before any
+// part of a response has been relayed.
+func (c *clientConn) fail(e routerError) connState {
+	log.Printf("Responding %d %s to %s", e.status, e.reason, requestLine(c.head))
+	if c.req != nil {
+		if _, err := c.conn.Write(e.response()); err != nil {
+			logError(err)
+		}
+	}
+	return stateClosing
+}
+
+// redial replaces a stale upstream connection and sends the request again
+func (c *clientConn) redial() connState {
+	c.drop(c.up)
+	c.up = nil
+	c.retried = true
+	return stateDialing
+}
+
+// drop closes an upstream connection and forgets it
+func (c *clientConn) drop(up *upstreamConn) {
+	c.mu.Lock()
+	open := c.upstreams[up.addr] == up
+	delete(c.upstreams, up.addr)
+	c.mu.Unlock()
+	closeConn(up.conn)
+	if open {
+		c.srv.trackUpstream(up.addr, -1)
+	}
+}
+
+// close closes the client connection and every upstream opened for it. It is
+// safe to call from outside serve, which then fails its next read or write.
+func (c *clientConn) close() {
+	closeConn(c.conn)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, up := range c.upstreams {
+		delete(c.upstreams, addr)
+		closeConn(up.conn)
+		c.srv.trackUpstream(addr, -1)
+	}
+}
+
+// clearReadDeadline removes any read deadline from the client connection
+func (c *clientConn) clearReadDeadline() {
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil && !isClosed(err) {
+		log.Printf("Error clearing read deadline: %v", err)
+	}
+}
+
+// tunnel relays bytes in both directions between the client and up until
+// either side closes, then closes both
+func (c *clientConn) tunnel(up *upstreamConn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.backward(up)
+	}()
+	c.forward(up)
+	<-done
+}
+
+// forward proxies data from the client connection to the destination server
+func (c *clientConn) forward(up *upstreamConn) {
+	defer closeConn(c.conn)
+	defer closeConn(up.conn)
+	if _, err := io.Copy(up.conn, c.br); err != nil {
+		logError(err)
+	}
+}
+
+// backward proxies data from the destination server back to the client connection
+func (c *clientConn) backward(up *upstreamConn) {
+	defer closeConn(up.conn)
+	defer closeConn(c.conn)
+	if _, err := io.Copy(c.conn, up.br); err != nil {
+		logError(err)
+	}
+}
+
+// closeConn closes conn, ignoring connections that are already closed
+func closeConn(conn net.Conn) {
+	if err := conn.Close(); err != nil && !isClosed(err) {
+		log.Printf("Error closing connection: %v", err)
+	}
+}
+
+// isClosed reports whether err comes from using a connection that has already
+// been closed on this side
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// logError logs errors other than those caused by closing a connection or
+// interrupting a read
+func logError(err error) {
+	if !isClosed(err) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Println(err)
+	}
+}
@@ -5,24 +5,36 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"runtime"
+	"testing"
 	"time"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
 )
 
 type connTester struct {
 	deadline time.Time
 	buffer   []byte
+	// readSize limits the bytes returned per Read, zero returns everything
+	readSize int
 }
 
 func (c *connTester) Read(b []byte) (n int, err error) {
-	copy(b, c.buffer)
-	length := len(c.buffer)
-	c.buffer = nil
-	if length == 0 {
+	if len(c.buffer) == 0 {
 		return 0, io.EOF
 	}
-	return length, nil
+	if c.readSize > 0 && len(b) > c.readSize {
+		b = b[:c.readSize]
+	}
+	n = copy(b, c.buffer)
+	c.buffer = c.buffer[n:]
+	return n, nil
 }
 
 func (c *connTester) Write(b []byte) (n int, err error) {
@@ -54,3 +66,225 @@ func (c *connTester) SetReadDeadline(t time.Time) error {
 func (c *connTester) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+// newRawUpstream starts a TCP server that runs handle for each connection
+func newRawUpstream(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closedAddr returns a local address that refuses connections
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// reset closes conn with an RST instead of a FIN
+func reset(conn net.Conn) {
+	_ = conn.(*net.TCPConn).SetLinger(0)
+	_ = conn.Close()
+}
+
+// assertGoroutinesReturn waits for the goroutine count to fall back to
+// baseline. It polls directly, since assert.Eventually runs its own goroutines.
+func assertGoroutinesReturn(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("goroutines leaked: %d running, baseline %d\n%s",
+				runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// assertClientClosed waits for the proxy to close the client connection
+func assertClientClosed(t *testing.T, client net.Conn) {
+	t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := io.ReadAll(client)
+	assert.NoError(t, err)
+}
+
+func TestConnStateString(t *testing.T) {
+	states := map[connState]string{
+		stateAccepting: "accepting",
+		stateIdle:      "idle",
+		stateRouting:   "routing",
+		stateDialing:   "dialing",
+		stateStreaming: "streaming",
+		stateClosing:   "closing",
+		connState(-1):  "unknown",
+	}
+	for state, want := range states {
+		assert.Equal(t, want, state.String())
+	}
+}
+
+func TestClientConnTransitions(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", closedAddr(t))
+	conn := &connTester{buffer: []byte("GET /api/v1/devices HTTP/1.1\r\n\r\n")}
+	c := newClientConn(srv, conn)
+	assert.Equal(t, stateAccepting, srv.conns[c])
+
+	assert.Equal(t, stateRouting, c.accept())
+	assert.NotNil(t, c.req)
+	assert.Equal(t, stateDialing, c.route())
+	assert.Equal(t, stateClosing, c.dial())
+	assert.Contains(t, string(conn.buffer), "HTTP/1.1 502 Bad Gateway\r\n")
+}
+
+func TestClientConnRoutesToOpenUpstream(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	c := newClientConn(srv, &connTester{buffer: []byte("original request")})
+	up := &upstreamConn{addr: "mps:3000"}
+	c.upstreams[up.addr] = up
+
+	assert.Equal(t, stateRouting, c.accept())
+	assert.Nil(t, c.req, "an incomplete head cannot be framed")
+	assert.Equal(t, stateStreaming, c.route())
+	assert.Same(t, up, c.up)
+}
+
+func TestServeUntrackedConnCloses(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	assertClientClosed(t, client)
+}
+
+func TestNoLeakOnDialFailure(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", closedAddr(t))
+	baseline := runtime.NumGoroutine()
+
+	client, app := net.Pipe()
+	go newClientConn(srv, app).serve()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.WriteString(client, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+	assertClientClosed(t, client)
+	_ = client.Close()
+
+	assertGoroutinesReturn(t, baseline)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Empty(t, srv.conns)
+}
+
+func TestNoLeakOnSilentClient(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", closedAddr(t))
+	srv.HeaderTimeout = 50 * time.Millisecond
+	addr, _ := startServer(t, srv)
+	baseline := runtime.NumGoroutine()
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	assertClientClosed(t, client)
+	_ = client.Close()
+
+	assertGoroutinesReturn(t, baseline)
+}
+
+func TestNoLeakOnClientReset(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+	}{
+		{"Awaiting Response", "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n"},
+		{"Sending Body", "POST /api/v1/devices HTTP/1.1\r\nHost: mps\r\nContent-Length: 100\r\n\r\npartial"},
+		{"Tunnel", "not http\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrived := make(chan struct{}, 1)
+			upstreamDone := make(chan struct{})
+			upstream := newRawUpstream(t, func(conn net.Conn) {
+				defer close(upstreamDone)
+				_, _ = conn.Read(make([]byte, 1024))
+				arrived <- struct{}{}
+				// never respond, wait for the proxy to give up on us
+				_, _ = io.Copy(io.Discard, conn)
+			})
+			srv := NewServer(&test.MockSQLDBManager{}, "", upstream)
+			addr, _ := startServer(t, srv)
+			baseline := runtime.NumGoroutine()
+
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			_, _ = io.WriteString(client, tt.req)
+			<-arrived
+			reset(client)
+
+			select {
+			case <-upstreamDone:
+			case <-time.After(3 * time.Second):
+				t.Fatal("upstream connection was not closed after the client reset")
+			}
+			assertGoroutinesReturn(t, baseline)
+		})
+	}
+}
+
+func TestNoLeakOnUpstreamReset(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		response string
+	}{
+		{"Before Response", "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n", ""},
+		{"During Body", "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial"},
+		{"Tunnel", "not http\r\n\r\n", "partial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newRawUpstream(t, func(conn net.Conn) {
+				_, _ = conn.Read(make([]byte, 1024))
+				_, _ = io.WriteString(conn, tt.response)
+				reset(conn)
+			})
+			srv := NewServer(&test.MockSQLDBManager{}, "", upstream)
+			addr, _ := startServer(t, srv)
+			baseline := runtime.NumGoroutine()
+
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			_, _ = io.WriteString(client, tt.req)
+			_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+			_, err = io.ReadAll(client)
+			assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "client connection was not closed")
+			_ = client.Close()
+
+			assertGoroutinesReturn(t, baseline)
+		})
+	}
+}
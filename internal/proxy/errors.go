@@ -0,0 +1,60 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// ErrorHeader carries the reason code of responses generated by the router
+const ErrorHeader = "X-MPS-Router-Error"
+
+// routerError describes a response the router sends in place of one from MPS
+type routerError struct {
+	// HTTP status code of the response
+	status int
+	// Reason code sent in ErrorHeader
+	reason string
+	// Human readable explanation sent in the body
+	message string
+}
+
+var (
+	errUpstreamUnreachable = routerError{http.StatusBadGateway, "upstream_unreachable", "Unable to connect to the MPS instance"}
+	errUpstreamClosed      = routerError{http.StatusBadGateway, "upstream_closed", "The MPS instance closed the connection without responding"}
+	errLookupTimeout       = routerError{http.StatusGatewayTimeout, "lookup_timeout", "Timed out looking up the MPS instance for the device"}
+	errOverloaded          = routerError{http.StatusServiceUnavailable, "overloaded", "Too many connections, try again later"}
+	errInvalidInstance     = routerError{http.StatusBadGateway, "invalid_instance", "The MPS instance recorded for the device is not a valid address"}
+	errUnknownDevice       = routerError{http.StatusNotFound, "unknown_device", "No MPS instance is known for the device"}
+	errDatabaseUnavailable = routerError{http.StatusServiceUnavailable, "database_unavailable", "Unable to look up the MPS instance for the device, try again later"}
+)
+
+func (e routerError) Error() string {
+	return e.message
+}
+
+// errorBody is the JSON body of a router error, shaped like MPS error payloads
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// response renders the complete HTTP response for the error. The connection
+// is always closed afterwards, since any request body has not been read.
+func (e routerError) response() []byte {
+	body, err := json.Marshal(errorBody{Error: http.StatusText(e.status), Message: e.message})
+	if err != nil {
+		log.Println(err)
+	}
+	return fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: application/json; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"%s: %s\r\n"+
+		"Connection: close\r\n\r\n%s",
+		e.status, http.StatusText(e.status), len(body), ErrorHeader, e.reason, body)
+}
@@ -0,0 +1,285 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/device-management-toolkit/mps-router/internal/db"
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowDB is a database whose queries take longer than the lookup timeout
+type slowDB struct {
+	test.MockSQLDBManager
+	delay time.Duration
+}
+
+func (m *slowDB) Query(guid string) string {
+	time.Sleep(m.delay)
+	return m.MockSQLDBManager.Query(guid)
+}
+
+// routeDB is a database whose lookups fail with err, or wait for ctx to be
+// done if err is nil
+type routeDB struct {
+	test.MockSQLDBManager
+	err error
+	// Receives the error of each lookup that waited for its ctx
+	cancelled chan error
+}
+
+func (m *routeDB) Lookup(ctx context.Context, guid string) (db.Route, error) {
+	if m.err != nil {
+		return db.Route{}, m.err
+	}
+	<-ctx.Done()
+	m.cancelled <- ctx.Err()
+	return db.Route{}, ctx.Err()
+}
+
+// readErrorResponse reads a router error response from conn and decodes its body
+func readErrorResponse(t *testing.T, conn net.Conn) (*http.Response, errorBody) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var body errorBody
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp, body
+}
+
+func TestRouterErrorResponse(t *testing.T) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(errUpstreamUnreachable.response())), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "upstream_unreachable", resp.Header.Get(ErrorHeader))
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.True(t, resp.Close)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"error":"Bad Gateway","message":"Unable to connect to the MPS instance"}`, string(body))
+}
+
+func TestRouterErrorResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, srv *Server)
+		req        string
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name:       "Dial Failure",
+			setup:      func(t *testing.T, srv *Server) {},
+			req:        "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n",
+			wantStatus: http.StatusBadGateway,
+			wantReason: "upstream_unreachable",
+		},
+		{
+			name:       "Dial Failure With Body",
+			setup:      func(t *testing.T, srv *Server) {},
+			req:        "POST /api/v1/devices HTTP/1.1\r\nHost: mps\r\nContent-Length: 2\r\n\r\n{}",
+			wantStatus: http.StatusBadGateway,
+			wantReason: "upstream_unreachable",
+		},
+		{
+			name: "Lookup Timeout",
+			setup: func(t *testing.T, srv *Server) {
+				srv.DB = &slowDB{MockSQLDBManager: test.MockSQLDBManager{QueryResult: "127.0.0.1"}, delay: 200 * time.Millisecond}
+				srv.LookupTimeout = 20 * time.Millisecond
+			},
+			req:        "GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n",
+			wantStatus: http.StatusGatewayTimeout,
+			wantReason: "lookup_timeout",
+		},
+		{
+			name: "Database Unavailable",
+			setup: func(t *testing.T, srv *Server) {
+				srv.DB = &routeDB{err: fmt.Errorf("%w: connection refused", db.ErrUnavailable)}
+			},
+			req:        "GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n",
+			wantStatus: http.StatusServiceUnavailable,
+			wantReason: "database_unavailable",
+		},
+		{
+			name: "Lookup Cancelled By Timeout",
+			setup: func(t *testing.T, srv *Server) {
+				srv.DB = &routeDB{cancelled: make(chan error, 1)}
+				srv.LookupTimeout = 20 * time.Millisecond
+			},
+			req:        "GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n",
+			wantStatus: http.StatusGatewayTimeout,
+			wantReason: "lookup_timeout",
+		},
+		{
+			name: "Upstream Closed",
+			setup: func(t *testing.T, srv *Server) {
+				srv.Target = newRawUpstream(t, func(conn net.Conn) {
+					_, _ = conn.Read(make([]byte, 1024))
+					_ = conn.Close()
+				})
+			},
+			req:        "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n",
+			wantStatus: http.StatusBadGateway,
+			wantReason: "upstream_closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(&test.MockSQLDBManager{}, "", closedAddr(t))
+			tt.setup(t, srv)
+			addr, _ := startServer(t, srv)
+			defer func() { _ = srv.Shutdown(t.Context()) }()
+
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer func() { _ = client.Close() }()
+			_, _ = io.WriteString(client, tt.req)
+
+			resp, body := readErrorResponse(t, client)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantReason, resp.Header.Get(ErrorHeader))
+			assert.Equal(t, http.StatusText(tt.wantStatus), body.Error)
+			assert.NotEmpty(t, body.Message)
+			assertClientClosed(t, client)
+		})
+	}
+}
+
+func TestStrictRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		req     string
+		want404 bool
+	}{
+		{"Unknown Device", true, "GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n", true},
+		{"No GUID", true, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n", false},
+		{"Disabled", false, "GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(&routeDB{err: db.ErrNotFound}, "", newNamedUpstream(t, "default"))
+			srv.StrictRouting = tt.strict
+			client, app := net.Pipe()
+			go newClientConn(srv, app).serve()
+			defer func() { _ = client.Close() }()
+			_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+			_, _ = io.WriteString(client, tt.req)
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if tt.want404 {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+				assert.Equal(t, "unknown_device", resp.Header.Get(ErrorHeader))
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Empty(t, resp.Header.Get(ErrorHeader))
+			}
+		})
+	}
+}
+
+func TestOverloadedResponds503(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv := NewServer(&test.MockSQLDBManager{}, "", newHeldUpstream(t, arrived, release))
+	srv.MaxConns = 1
+	addr, _ := startServer(t, srv)
+
+	// the first connection holds the only slot until its response is released
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+	_, _ = io.WriteString(first, "GET /held HTTP/1.1\r\nHost: mps\r\n\r\n")
+	<-arrived
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+	_, _ = io.WriteString(second, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+
+	resp, body := readErrorResponse(t, second)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "overloaded", resp.Header.Get(ErrorHeader))
+	assert.Equal(t, "Service Unavailable", body.Error)
+}
+
+func TestUnframedDialFailureCloses(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", closedAddr(t))
+	client, app := net.Pipe()
+	go newClientConn(srv, app).serve()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.WriteString(client, "original request\r\n\r\n")
+
+	// traffic that is not HTTP gets no HTTP response
+	data, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestNoErrorAfterResponseRelayed(t *testing.T) {
+	upstream := newRawUpstream(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 1024))
+		_, _ = io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		_ = conn.Close()
+	})
+	srv := NewServer(&test.MockSQLDBManager{}, "", upstream)
+	client, app := net.Pipe()
+	go newClientConn(srv, app).serve()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.WriteString(client, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+
+	data, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(data))
+}
+
+func TestClientResetCancelsLookup(t *testing.T) {
+	database := &routeDB{cancelled: make(chan error, 1)}
+	srv := NewServer(database, "", closedAddr(t))
+	addr, _ := startServer(t, srv)
+	defer func() { _ = srv.Shutdown(t.Context()) }()
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	_, _ = io.WriteString(client, "GET /api/v1/amt/log/audit/"+guidA+" HTTP/1.1\r\nHost: mps\r\n\r\n")
+	// closing without lingering resets the connection
+	_ = client.(*net.TCPConn).SetLinger(0)
+	_ = client.Close()
+
+	select {
+	case err := <-database.cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(3 * time.Second):
+		t.Fatal("lookup was not cancelled when the client disconnected")
+	}
+}
@@ -0,0 +1,219 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCheckInterval is the default time between health checks
+	DefaultCheckInterval = 10 * time.Second
+	// DefaultCheckTimeout is the default time allowed for one health check
+	DefaultCheckTimeout = 2 * time.Second
+	// DefaultHealthyThreshold is the default number of consecutive successful
+	// checks before an unhealthy upstream is healthy again
+	DefaultHealthyThreshold = 2
+	// DefaultUnhealthyThreshold is the default number of consecutive failed
+	// checks before a healthy upstream is unhealthy
+	DefaultUnhealthyThreshold = 3
+)
+
+// UpstreamHealth is the health of an MPS instance as last checked
+type UpstreamHealth struct {
+	Healthy bool
+	// Time of the last check, zero before the first
+	LastCheck time.Time
+	// Error of the last check, empty when it succeeded
+	LastError string
+	// Number of checks in a row that have failed or succeeded
+	Failures  int
+	Successes int
+}
+
+// HealthChecker periodically probes MPS instances with a TCP connect or, when
+// Path is set, an HTTP GET. An instance changes state only after several
+// checks in a row agree, so a single slow probe does not take it out of
+// rotation. Instances start out healthy. HealthChecker is safe for concurrent
+// use.
+type HealthChecker struct {
+	// Time between rounds of checks
+	Interval time.Duration
+	// Time allowed for each check
+	Timeout time.Duration
+	// HTTP path to request, such as "/api/v1/health", empty to only connect.
+	// Responses with a status below 400 count as healthy.
+	Path string
+	// Consecutive successes that make an unhealthy instance healthy
+	HealthyThreshold int
+	// Consecutive failures that make a healthy instance unhealthy
+	UnhealthyThreshold int
+
+	mu      sync.RWMutex
+	targets map[string]*UpstreamHealth
+}
+
+// NewHealthChecker creates a health checker for addrs with default settings
+func NewHealthChecker(addrs ...string) *HealthChecker {
+	h := &HealthChecker{
+		Interval:           DefaultCheckInterval,
+		Timeout:            DefaultCheckTimeout,
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+		targets:            map[string]*UpstreamHealth{},
+	}
+	for _, addr := range addrs {
+		h.Add(addr)
+	}
+	return h
+}
+
+// Add starts checking addr, which is considered healthy until checked
+func (h *HealthChecker) Add(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.targets[addr]; !ok {
+		h.targets[addr] = &UpstreamHealth{Healthy: true}
+	}
+}
+
+// Remove stops checking addr
+func (h *HealthChecker) Remove(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.targets, addr)
+}
+
+// Healthy reports whether addr is healthy. Addresses that are not checked are
+// always healthy. A nil *HealthChecker reports every address as healthy.
+func (h *HealthChecker) Healthy(addr string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	state, ok := h.targets[addr]
+	return !ok || state.Healthy
+}
+
+// Status returns the health of every checked address, nil for a nil
+// *HealthChecker
+func (h *HealthChecker) Status() map[string]UpstreamHealth {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := make(map[string]UpstreamHealth, len(h.targets))
+	for addr, state := range h.targets {
+		status[addr] = *state
+	}
+	return status
+}
+
+// Run checks every address each Interval until ctx is done
+func (h *HealthChecker) Run(ctx context.Context) {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs one round of checks on every address in parallel and waits for
+// them to finish
+func (h *HealthChecker) Check(ctx context.Context) {
+	h.mu.RLock()
+	addrs := make([]string, 0, len(h.targets))
+	for addr := range h.targets {
+		addrs = append(addrs, addr)
+	}
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Go(func() {
+			h.record(addr, h.probe(ctx, addr))
+		})
+	}
+	wg.Wait()
+}
+
+// probe checks a single address
+func (h *HealthChecker) probe(ctx context.Context, addr string) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if h.Path == "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+h.Path, http.NoBody)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// record applies the result of a check to the state of addr
+func (h *HealthChecker) record(addr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.targets[addr]
+	if !ok {
+		return
+	}
+	state.LastCheck = time.Now()
+	if err != nil {
+		state.LastError = err.Error()
+		state.Failures++
+		state.Successes = 0
+		if state.Healthy && state.Failures >= max(h.UnhealthyThreshold, 1) {
+			state.Healthy = false
+			log.Printf("MPS instance %s is unhealthy: %v", addr, err)
+		}
+		return
+	}
+	state.LastError = ""
+	state.Successes++
+	state.Failures = 0
+	if !state.Healthy && state.Successes >= max(h.HealthyThreshold, 1) {
+		state.Healthy = true
+		log.Printf("MPS instance %s is healthy again", addr)
+	}
+}
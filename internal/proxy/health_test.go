@@ -0,0 +1,223 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// newHealthUpstream starts an MPS stand-in whose health endpoint answers with
+// the status held in status
+func newHealthUpstream(t *testing.T, status *atomic.Int32) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestHealthCheckerProbe(t *testing.T) {
+	var ok, failing atomic.Int32
+	ok.Store(http.StatusOK)
+	failing.Store(http.StatusServiceUnavailable)
+	healthy, unhealthy, down := newHealthUpstream(t, &ok), newHealthUpstream(t, &failing), closedAddr(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		addr    string
+		wantErr bool
+	}{
+		{"TCP Open", "", unhealthy, false},
+		{"TCP Closed", "", down, true},
+		{"HTTP OK", "/api/v1/health", healthy, false},
+		{"HTTP Error Status", "/api/v1/health", unhealthy, true},
+		{"HTTP Wrong Path", "/missing", healthy, true},
+		{"HTTP Closed", "/api/v1/health", down, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealthChecker()
+			h.Path = tt.path
+			err := h.probe(context.Background(), tt.addr)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHealthCheckerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	h := NewHealthChecker()
+	h.Path = "/api/v1/health"
+	h.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	assert.Error(t, h.probe(context.Background(), ts.Listener.Addr().String()))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestHealthCheckerHysteresis(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	addr := newHealthUpstream(t, &status)
+	h := NewHealthChecker(addr)
+	h.Path = "/api/v1/health"
+	h.UnhealthyThreshold = 2
+	h.HealthyThreshold = 3
+	ctx := context.Background()
+
+	assert.True(t, h.Healthy(addr), "instances start out healthy")
+	h.Check(ctx)
+	assert.True(t, h.Healthy(addr))
+	assert.Equal(t, 1, h.Status()[addr].Successes)
+
+	// a single failure is tolerated
+	status.Store(http.StatusInternalServerError)
+	h.Check(ctx)
+	assert.True(t, h.Healthy(addr))
+	status.Store(http.StatusOK)
+	h.Check(ctx)
+	assert.True(t, h.Healthy(addr))
+
+	status.Store(http.StatusInternalServerError)
+	h.Check(ctx)
+	h.Check(ctx)
+	assert.False(t, h.Healthy(addr))
+	state := h.Status()[addr]
+	assert.Equal(t, 2, state.Failures)
+	assert.Contains(t, state.LastError, "500")
+	assert.False(t, state.LastCheck.IsZero())
+
+	// recovery takes HealthyThreshold successes in a row
+	status.Store(http.StatusOK)
+	h.Check(ctx)
+	h.Check(ctx)
+	assert.False(t, h.Healthy(addr))
+	h.Check(ctx)
+	assert.True(t, h.Healthy(addr))
+	assert.Empty(t, h.Status()[addr].LastError)
+}
+
+func TestHealthCheckerUnknownAddress(t *testing.T) {
+	h := NewHealthChecker("mps-0:3000")
+	assert.True(t, h.Healthy("mps-1:3000"))
+	var none *HealthChecker
+	assert.True(t, none.Healthy("mps-0:3000"))
+	assert.Nil(t, none.Status())
+}
+
+func TestHealthCheckerRun(t *testing.T) {
+	down := closedAddr(t)
+	h := NewHealthChecker(down)
+	h.Interval = 10 * time.Millisecond
+	h.UnhealthyThreshold = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool { return !h.Healthy(down) }, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestDefaultTargetsSkipUnhealthy(t *testing.T) {
+	down := closedAddr(t)
+	var ok atomic.Int32
+	ok.Store(http.StatusOK)
+	up := newHealthUpstream(t, &ok)
+	pool, err := ParsePool(RoundRobin, down+","+up, "mps:3000")
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	srv.Pool = pool
+	srv.Health = NewHealthChecker(pool.Addrs()...)
+	srv.Health.UnhealthyThreshold = 1
+
+	// before any check both take turns
+	assert.Equal(t, []string{down, up}, srv.defaultTargets())
+	assert.Equal(t, []string{up, down}, srv.defaultTargets())
+
+	srv.Health.Check(context.Background())
+	for range 3 {
+		// the unhealthy instance is only kept as a last resort
+		assert.Equal(t, []string{up, down}, srv.defaultTargets())
+	}
+}
+
+func TestAliasAddressesSkipUnhealthy(t *testing.T) {
+	down := closedAddr(t)
+	var ok atomic.Int32
+	ok.Store(http.StatusOK)
+	up := newHealthUpstream(t, &ok)
+	aliases, err := LoadAliases(writeAliases(t, "aliases.yaml", "mps-0:\n  - "+down+"\n  - "+up+"\n"))
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{QueryResult: "mps-0"}, "", "mps:3000")
+	srv.Aliases = aliases
+	srv.Health = NewHealthChecker(srv.Target)
+	srv.Health.UnhealthyThreshold = 1
+	srv.CheckAliases()
+	head := []byte("GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n")
+
+	addrs, err := srv.destinations(context.Background(), head)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{down, up}, addrs, "before any check the file order is kept")
+
+	srv.Health.Check(context.Background())
+	addrs, err = srv.destinations(context.Background(), head)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{up, down}, addrs, "the unhealthy address is only kept as a last resort")
+}
+
+func TestCheckAliases(t *testing.T) {
+	path := writeAliases(t, "aliases.yaml", "mps-0:\n  - mps-a\n  - mps-b:3001\nmps-1: mps:3000\n")
+	aliases, err := LoadAliases(path)
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	srv.Aliases = aliases
+	srv.Health = NewHealthChecker(srv.Target)
+	srv.CheckAliases()
+	aliases.OnReload(srv.CheckAliases)
+	assert.ElementsMatch(t, []string{"mps:3000", "mps-a:3000", "mps-b:3001"}, slices.Collect(maps.Keys(srv.Health.Status())))
+
+	// addresses of removed aliases are no longer checked, unlike the default
+	// target
+	assert.NoError(t, os.WriteFile(path, []byte("mps-0: mps-c\n"), 0o600))
+	assert.NoError(t, aliases.Reload())
+	assert.ElementsMatch(t, []string{"mps:3000", "mps-c:3000"}, slices.Collect(maps.Keys(srv.Health.Status())))
+
+	// without a health checker there is nothing to register
+	srv.Health = nil
+	srv.CheckAliases()
+}
@@ -0,0 +1,265 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// bodyKind describes how the end of an HTTP message body is found
+type bodyKind int
+
+const (
+	// bodyNone means the message has no body
+	bodyNone bodyKind = iota
+	// bodyLength means the body is Content-Length bytes long
+	bodyLength
+	// bodyChunked means the body uses the chunked transfer coding
+	bodyChunked
+	// bodyUntilClose means the body ends when the connection is closed
+	bodyUntilClose
+)
+
+// errBadFraming is returned when the length of a message cannot be determined
+var errBadFraming = errors.New("invalid message framing")
+
+// messageHead holds the parts of an HTTP/1.x message head that are needed to
+// relay the message without re-encoding it
+type messageHead struct {
+	// Request method, empty for responses
+	method string
+	// Response status code, zero for requests
+	status int
+	// Minor version of the HTTP/1.x protocol
+	minor  int
+	header textproto.MIMEHeader
+	// How the body that follows the head is framed
+	body bodyKind
+	// Body length when body is bodyLength
+	length int64
+}
+
+// readHead reads from br until a complete message head has been buffered or
+// maxBytes is reached. The head is returned with its terminating blank line;
+// bytes following it are left in br. If the head is incomplete, everything
+// read so far is returned along with the error that stopped the read.
+func readHead(br *bufio.Reader, maxBytes int) ([]byte, error) {
+	maxBytes = min(maxBytes, br.Size())
+	scanned := 0
+	for {
+		buf, _ := br.Peek(br.Buffered())
+		if i := bytes.Index(buf[scanned:], headTerminator); i >= 0 {
+			return consume(br, scanned+i+len(headTerminator)), nil
+		}
+		if len(buf) >= maxBytes {
+			return consume(br, len(buf)), nil
+		}
+		// only the tail can complete the terminator, so avoid rescanning the head
+		scanned = max(len(buf)-len(headTerminator)+1, 0)
+		if _, err := br.Peek(len(buf) + 1); err != nil {
+			return consume(br, br.Buffered()), err
+		}
+	}
+}
+
+// consume copies the next n bytes out of br and advances past them
+func consume(br *bufio.Reader, n int) []byte {
+	b, _ := br.Peek(n)
+	b = bytes.Clone(b)
+	_, _ = br.Discard(n)
+	return b
+}
+
+// requestLine returns the first line of a request head for logging
+func requestLine(head []byte) string {
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	return string(bytes.TrimSpace(line))
+}
+
+// parseRequestHead parses a complete HTTP/1.x request head
+func parseRequestHead(head []byte) (*messageHead, error) {
+	line, header, err := splitHead(head)
+	if err != nil {
+		return nil, err
+	}
+	method, rest, ok1 := strings.Cut(line, " ")
+	_, proto, ok2 := strings.Cut(rest, " ")
+	major, minor, ok3 := http.ParseHTTPVersion(proto)
+	if !ok1 || !ok2 || !ok3 || major != 1 || method == "" {
+		return nil, errors.New("malformed request line: " + line)
+	}
+	h := &messageHead{method: method, minor: minor, header: header}
+
+	switch {
+	case header.Get("Transfer-Encoding") != "":
+		if !isChunked(header) {
+			return nil, errBadFraming
+		}
+		h.body = bodyChunked
+	case len(header.Values("Content-Length")) > 0:
+		if h.length, err = contentLength(header); err != nil {
+			return nil, err
+		}
+		h.body = bodyLength
+	}
+	return h, nil
+}
+
+// parseResponseHead parses a complete HTTP/1.x response head sent in reply
+// to req
+func parseResponseHead(head []byte, req *messageHead) (*messageHead, error) {
+	line, header, err := splitHead(head)
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	status, err := strconv.Atoi(code)
+	if !ok || major != 1 || err != nil || len(code) != 3 || status < 100 {
+		return nil, errors.New("malformed status line: " + line)
+	}
+	h := &messageHead{status: status, minor: minor, header: header}
+
+	switch {
+	case req.method == http.MethodHead, status < 200, status == http.StatusNoContent, status == http.StatusNotModified:
+		h.body = bodyNone
+	case req.method == http.MethodConnect && status < 300:
+		h.body = bodyUntilClose
+	case header.Get("Transfer-Encoding") != "":
+		h.body = bodyUntilClose
+		if isChunked(header) {
+			h.body = bodyChunked
+		}
+	case len(header.Values("Content-Length")) > 0:
+		if h.length, err = contentLength(header); err != nil {
+			return nil, err
+		}
+		h.body = bodyLength
+	default:
+		h.body = bodyUntilClose
+	}
+	return h, nil
+}
+
+// splitHead splits a message head into its start line and header fields
+func splitHead(head []byte) (string, textproto.MIMEHeader, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(head)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	return line, header, nil
+}
+
+// isChunked reports whether chunked is the final transfer coding
+func isChunked(header textproto.MIMEHeader) bool {
+	codings := strings.Split(strings.Join(header.Values("Transfer-Encoding"), ","), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// contentLength returns the Content-Length of a message, rejecting
+// conflicting or malformed values
+func contentLength(header textproto.MIMEHeader) (int64, error) {
+	values := header.Values("Content-Length")
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return 0, errBadFraming
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errBadFraming
+	}
+	return n, nil
+}
+
+// hasToken reports whether a comma separated header field contains token
+func hasToken(header textproto.MIMEHeader, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keepAlive reports whether the connection stays open after this message
+func (h *messageHead) keepAlive() bool {
+	if h.minor == 0 {
+		return hasToken(h.header, "Connection", "keep-alive")
+	}
+	return !hasToken(h.header, "Connection", "close")
+}
+
+// copyBody relays the body of a message from src to dst byte for byte
+func copyBody(dst io.Writer, src *bufio.Reader, h *messageHead) error {
+	switch h.body {
+	case bodyLength:
+		_, err := io.CopyN(dst, src, h.length)
+		return err
+	case bodyChunked:
+		return copyChunked(dst, src)
+	case bodyUntilClose:
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return nil
+}
+
+// copyChunked relays a chunked body, including its trailer section, without
+// decoding it
+func copyChunked(dst io.Writer, src *bufio.Reader) error {
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return errBadFraming
+		}
+		if size == 0 {
+			return copyTrailer(dst, src)
+		}
+		// chunk data is followed by CRLF
+		if _, err := io.CopyN(dst, src, size+2); err != nil {
+			return err
+		}
+	}
+}
+
+// copyTrailer relays trailer fields up to and including the final blank line
+func copyTrailer(dst io.Writer, src *bufio.Reader) error {
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+	}
+}
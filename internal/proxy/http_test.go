@@ -0,0 +1,118 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequestHead(t *testing.T) {
+	tests := []struct {
+		name      string
+		head      string
+		wantBody  bodyKind
+		wantLen   int64
+		keepAlive bool
+		wantErr   bool
+	}{
+		{"No Body", "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n", bodyNone, 0, true, false},
+		{"Content Length", "POST /x HTTP/1.1\r\nContent-Length: 12\r\n\r\n", bodyLength, 12, true, false},
+		{"Repeated Content Length", "POST /x HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\n", bodyLength, 3, true, false},
+		{"Chunked", "POST /x HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", bodyChunked, 0, true, false},
+		{"Connection Close", "GET /x HTTP/1.1\r\nConnection: close\r\n\r\n", bodyNone, 0, false, false},
+		{"HTTP 1.0", "GET /x HTTP/1.0\r\n\r\n", bodyNone, 0, false, false},
+		{"HTTP 1.0 Keep Alive", "GET /x HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", bodyNone, 0, true, false},
+		{"Conflicting Content Length", "POST /x HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\n", bodyNone, 0, false, true},
+		{"Negative Content Length", "POST /x HTTP/1.1\r\nContent-Length: -1\r\n\r\n", bodyNone, 0, false, true},
+		{"Unchunked Transfer Encoding", "POST /x HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", bodyNone, 0, false, true},
+		{"HTTP 2", "PRI * HTTP/2.0\r\n\r\n", bodyNone, 0, false, true},
+		{"Not HTTP", "original request\r\n\r\n", bodyNone, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRequestHead([]byte(tt.head))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantBody, got.body)
+			assert.Equal(t, tt.wantLen, got.length)
+			assert.Equal(t, tt.keepAlive, got.keepAlive())
+		})
+	}
+}
+
+func TestParseResponseHead(t *testing.T) {
+	get := &messageHead{method: "GET"}
+	tests := []struct {
+		name     string
+		head     string
+		req      *messageHead
+		wantCode int
+		wantBody bodyKind
+		wantErr  bool
+	}{
+		{"Content Length", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", get, 200, bodyLength, false},
+		{"Chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", get, 200, bodyChunked, false},
+		{"Until Close", "HTTP/1.0 200 OK\r\n\r\n", get, 200, bodyUntilClose, false},
+		{"Head Request", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", &messageHead{method: "HEAD"}, 200, bodyNone, false},
+		{"Connect Request", "HTTP/1.1 200 OK\r\n\r\n", &messageHead{method: "CONNECT"}, 200, bodyUntilClose, false},
+		{"No Content", "HTTP/1.1 204 No Content\r\n\r\n", get, 204, bodyNone, false},
+		{"Not Modified", "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n", get, 304, bodyNone, false},
+		{"Continue", "HTTP/1.1 100 Continue\r\n\r\n", get, 100, bodyNone, false},
+		{"Switching Protocols", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n", get, 101, bodyNone, false},
+		{"Malformed Status", "HTTP/1.1 2000 OK\r\n\r\n", get, 0, bodyNone, true},
+		{"Not HTTP", "echo:GET / HTTP/1.1\r\n\r\n", get, 0, bodyNone, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResponseHead([]byte(tt.head), tt.req)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCode, got.status)
+			assert.Equal(t, tt.wantBody, got.body)
+		})
+	}
+}
+
+func TestCopyBodyChunked(t *testing.T) {
+	body := "4\r\nWiki\r\n7;ext=1\r\npedia i\r\n0\r\nExpires: never\r\n\r\n"
+	src := bufio.NewReader(strings.NewReader(body + "GET /next HTTP/1.1\r\n\r\n"))
+	var dst bytes.Buffer
+	err := copyBody(&dst, src, &messageHead{body: bodyChunked})
+	assert.NoError(t, err)
+	assert.Equal(t, body, dst.String())
+
+	// the next message is left unread
+	rest, _ := io.ReadAll(src)
+	assert.Equal(t, "GET /next HTTP/1.1\r\n\r\n", string(rest))
+}
+
+func TestCopyBodyChunkedErrors(t *testing.T) {
+	var dst bytes.Buffer
+	err := copyBody(&dst, bufio.NewReader(strings.NewReader("zz\r\n")), &messageHead{body: bodyChunked})
+	assert.Equal(t, errBadFraming, err)
+
+	err = copyBody(&dst, bufio.NewReader(strings.NewReader("4\r\nWi")), &messageHead{body: bodyChunked})
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCopyBodyLength(t *testing.T) {
+	src := bufio.NewReader(strings.NewReader("bodyrest"))
+	var dst bytes.Buffer
+	err := copyBody(&dst, src, &messageHead{body: bodyLength, length: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, "body", dst.String())
+}
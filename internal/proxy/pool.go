@@ -0,0 +1,189 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Strategy selects which member of a Pool receives the next connection
+type Strategy string
+
+const (
+	// RoundRobin takes members in turn
+	RoundRobin Strategy = "round-robin"
+	// LeastConnections takes the member with the fewest open upstream
+	// connections, in turn among equals
+	LeastConnections Strategy = "least-connections"
+	// Weighted takes members in turn in proportion to their weights
+	Weighted Strategy = "weighted"
+)
+
+// PoolMember is an MPS instance in a Pool
+type PoolMember struct {
+	// Address of the instance, in any form accepted for an instance
+	Address string `yaml:"address"`
+	// Relative share of connections under the Weighted strategy, one when zero
+	Weight int `yaml:"weight"`
+}
+
+// Pool is a set of interchangeable MPS instances that serve requests without a
+// device GUID. It is safe for concurrent use.
+type Pool struct {
+	strategy Strategy
+
+	mu      sync.Mutex
+	members []*poolMember
+	// Index of the member to start from for RoundRobin and LeastConnections
+	next int
+}
+
+type poolMember struct {
+	addr   string
+	weight int
+	// Running weight used by the smooth weighted round-robin of Weighted
+	current int
+}
+
+// poolFile is the format of a pool configuration file
+type poolFile struct {
+	Strategy Strategy     `yaml:"strategy"`
+	Targets  []PoolMember `yaml:"targets"`
+}
+
+// NewPool creates a pool of members using strategy, RoundRobin when empty.
+// Addresses without a port take the port of defaultTarget.
+func NewPool(strategy Strategy, members []PoolMember, defaultTarget string) (*Pool, error) {
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	switch strategy {
+	case RoundRobin, LeastConnections, Weighted:
+	default:
+		return nil, fmt.Errorf("unknown pool strategy %q", strategy)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("pool has no targets")
+	}
+	p := &Pool{strategy: strategy}
+	for _, m := range members {
+		addr, err := instanceAddress(m.Address, defaultTarget)
+		if err != nil {
+			return nil, err
+		}
+		if m.Weight < 0 {
+			return nil, fmt.Errorf("negative weight for pool target %q", m.Address)
+		}
+		p.members = append(p.members, &poolMember{addr: addr, weight: max(m.Weight, 1)})
+	}
+	return p, nil
+}
+
+// ParsePool creates a pool from a comma separated list of addresses, each
+// optionally followed by "=weight", such as "mps-0:3000=3,mps-1:3000"
+func ParsePool(strategy Strategy, list, defaultTarget string) (*Pool, error) {
+	var members []PoolMember
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		m := PoolMember{Address: item}
+		if addr, weight, ok := strings.Cut(item, "="); ok {
+			w, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight for pool target %q", item)
+			}
+			m = PoolMember{Address: strings.TrimSpace(addr), Weight: w}
+		}
+		members = append(members, m)
+	}
+	return NewPool(strategy, members, defaultTarget)
+}
+
+// LoadPool creates a pool from a YAML or JSON file of the form
+//
+//	strategy: weighted
+//	targets:
+//	  - address: mps-0:3000
+//	    weight: 3
+//	  - address: mps-1:3000
+func LoadPool(path, defaultTarget string) (*Pool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f poolFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("pool file %s: %w", path, err)
+	}
+	p, err := NewPool(f.Strategy, f.Targets, defaultTarget)
+	if err != nil {
+		return nil, fmt.Errorf("pool file %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Addrs returns the addresses of the pool members in configuration order
+func (p *Pool) Addrs() []string {
+	addrs := make([]string, len(p.members))
+	for i, m := range p.members {
+		addrs[i] = m.addr
+	}
+	return addrs
+}
+
+// order returns every member address, starting with the one chosen by the
+// strategy and followed by the rest to fail over to. active reports the open
+// upstream connections to an address.
+func (p *Pool) order(active func(addr string) int) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	first := p.pick(active)
+	addrs := make([]string, 0, len(p.members))
+	for i := range p.members {
+		addrs = append(addrs, p.members[(first+i)%len(p.members)].addr)
+	}
+	return addrs
+}
+
+// pick returns the index of the member chosen by the strategy
+func (p *Pool) pick(active func(addr string) int) int {
+	n := len(p.members)
+	switch p.strategy {
+	case LeastConnections:
+		start := p.next
+		p.next = (p.next + 1) % n
+		best, least := start, active(p.members[start].addr)
+		for i := 1; i < n; i++ {
+			j := (start + i) % n
+			if count := active(p.members[j].addr); count < least {
+				best, least = j, count
+			}
+		}
+		return best
+	case Weighted:
+		best, total := 0, 0
+		for i, m := range p.members {
+			m.current += m.weight
+			total += m.weight
+			if m.current > p.members[best].current {
+				best = i
+			}
+		}
+		p.members[best].current -= total
+		return best
+	default:
+		i := p.next
+		p.next = (p.next + 1) % n
+		return i
+	}
+}
@@ -0,0 +1,149 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// firstPicks returns the address chosen first on each of n calls to order
+func firstPicks(p *Pool, n int, active func(string) int) []string {
+	picks := make([]string, n)
+	for i := range picks {
+		picks[i] = p.order(active)[0]
+	}
+	return picks
+}
+
+func noConns(string) int { return 0 }
+
+func TestParsePool(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		list     string
+		want     []string
+		wantErr  bool
+	}{
+		{"Addresses", "", "mps-0:3000, mps-1:3001", []string{"mps-0:3000", "mps-1:3001"}, false},
+		{"Default Port", RoundRobin, "mps-0,[fd00::5]", []string{"mps-0:3000", "[fd00::5]:3000"}, false},
+		{"Weights", Weighted, "mps-0=3,mps-1:3001=1,", []string{"mps-0:3000", "mps-1:3001"}, false},
+		{"Empty", RoundRobin, " , ", nil, true},
+		{"Bad Weight", Weighted, "mps-0=heavy", nil, true},
+		{"Negative Weight", Weighted, "mps-0=-1", nil, true},
+		{"Bad Address", RoundRobin, "mps-0:port", nil, true},
+		{"Unknown Strategy", "random", "mps-0", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePool(tt.strategy, tt.list, "mps:3000")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, p.Addrs())
+		})
+	}
+}
+
+func TestLoadPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.yaml")
+	content := "strategy: weighted\ntargets:\n  - address: mps-0\n    weight: 2\n  - address: mps-1:3001\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	p, err := LoadPool(path, "mps:3000")
+	assert.NoError(t, err)
+	assert.Equal(t, Weighted, p.strategy)
+	assert.Equal(t, []string{"mps-0:3000", "mps-1:3001"}, p.Addrs())
+	assert.Equal(t, []string{"mps-0:3000", "mps-1:3001", "mps-0:3000"}, firstPicks(p, 3, noConns))
+
+	assert.NoError(t, os.WriteFile(path, []byte("strategy: random\ntargets:\n  - address: mps-0\n"), 0o600))
+	_, err = LoadPool(path, "mps:3000")
+	assert.Error(t, err)
+
+	_, err = LoadPool(filepath.Join(t.TempDir(), "missing.yaml"), "mps:3000")
+	assert.Error(t, err)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p, err := ParsePool(RoundRobin, "a:1,b:1,c:1", "mps:3000")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1", "a:1"}, firstPicks(p, 4, noConns))
+	// the other members follow as failover candidates
+	assert.Equal(t, []string{"b:1", "c:1", "a:1"}, p.order(noConns))
+}
+
+func TestPoolWeighted(t *testing.T) {
+	p, err := ParsePool(Weighted, "a:1=3,b:1=1", "mps:3000")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "a:1", "b:1", "a:1", "a:1", "a:1", "b:1", "a:1"}, firstPicks(p, 8, noConns))
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	p, err := ParsePool(LeastConnections, "a:1,b:1,c:1", "mps:3000")
+	assert.NoError(t, err)
+	active := map[string]int{"a:1": 2, "b:1": 0, "c:1": 1}
+	count := func(addr string) int { return active[addr] }
+	assert.Equal(t, []string{"b:1", "c:1", "a:1"}, p.order(count))
+
+	// ties are broken in turn
+	active["b:1"] = 1
+	assert.Equal(t, []string{"b:1", "c:1", "b:1"}, firstPicks(p, 3, count))
+}
+
+func TestPoolServesRequestsWithoutGUID(t *testing.T) {
+	pool, err := ParsePool(LeastConnections, "mps-0:3000,mps-1:3000", "mps:3000")
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	srv.Pool = pool
+	recorder := &dialRecorder{hosts: map[string]string{
+		"mps-0": newNamedUpstream(t, "0"),
+		"mps-1": newNamedUpstream(t, "1"),
+	}}
+	srv.dial = recorder.dial
+
+	// each kept-alive client holds its upstream, so the next client goes to
+	// the other instance
+	var clients []net.Conn
+	var got []string
+	for range 2 {
+		client, app := net.Pipe()
+		clients = append(clients, client)
+		go newClientConn(srv, app).serve()
+		got = append(got, roundTrip(t, client, bufio.NewReader(client), "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	}
+	assert.ElementsMatch(t, []string{"0 /api/v1/devices", "1 /api/v1/devices"}, got)
+	assert.Equal(t, 1, srv.activeUpstreams("mps-0:3000"))
+	assert.Equal(t, 1, srv.activeUpstreams("mps-1:3000"))
+
+	for _, client := range clients {
+		_ = client.Close()
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && srv.activeUpstreams("mps-0:3000")+srv.activeUpstreams("mps-1:3000") > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, srv.activeUpstreams("mps-0:3000"))
+	assert.Equal(t, 0, srv.activeUpstreams("mps-1:3000"))
+}
+
+func TestPoolUsedForUnknownDevices(t *testing.T) {
+	pool, err := ParsePool(RoundRobin, "mps-0:3000,mps-1:3000", "mps:3000")
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	srv.Pool = pool
+	got, err := srv.destinations(context.Background(), []byte("GET /api/v1/amt/log/audit/"+guidA+" HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mps-0:3000", "mps-1:3000"}, got)
+}
@@ -5,13 +5,16 @@
 package proxy
 
 import (
-	"bytes"
-	"io"
+	"context"
+	"errors"
 	"log"
 	"net"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/device-management-toolkit/mps-router/internal/db"
 )
@@ -21,6 +24,29 @@ import (
 // The following guid checks for any uuid/guid format, not following RFC4122 explicitly
 var guidRegEx = regexp.MustCompile("[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}")
 
+// headTerminator marks the end of an HTTP message head
+var headTerminator = []byte("\r\n\r\n")
+
+const (
+	// DefaultMaxHeaderBytes is the default limit on the bytes buffered while
+	// waiting for a complete request head
+	DefaultMaxHeaderBytes = 65535
+	// DefaultHeaderTimeout is the default time a client has to send a complete
+	// request head
+	DefaultHeaderTimeout = 10 * time.Second
+	// DefaultDialTimeout is the default time allowed for connecting to an MPS instance
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultLookupTimeout is the default time allowed for finding the MPS
+	// instance of a device
+	DefaultLookupTimeout = 10 * time.Second
+
+	// shutdownPollInterval is how often Shutdown checks for drained connections
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+// ErrServerClosed is returned by ListenAndServe after a call to Shutdown
+var ErrServerClosed = errors.New("proxy: Server closed")
+
 // Server is a TCP server that takes an incoming request and sends it to another
 // server, proxying the response back to the client.
 type Server struct {
@@ -30,48 +56,207 @@ type Server struct {
 	Target string
 	// Database manager
 	DB db.Manager
+	// Maximum number of bytes buffered while waiting for the request head.
+	// Routing happens on whatever has been buffered once the limit is reached.
+	MaxHeaderBytes int
+	// Maximum time to wait for the request head, zero means no deadline. It
+	// also bounds how long a kept-alive connection may stay idle between
+	// requests.
+	HeaderTimeout time.Duration
+	// Maximum time to wait for a connection to an MPS instance, zero means
+	// no timeout beyond the operating system's
+	DialTimeout time.Duration
+	// Maximum time to wait for the database to return the MPS instance of a
+	// device, zero means no timeout
+	LookupTimeout time.Duration
+	// Maximum number of client connections served at once, zero means no
+	// limit. Requests on connections beyond the limit get a 503 response.
+	MaxConns int
+	// Reject requests for a device GUID that has no MPS instance in the
+	// database with a 404 response instead of routing them to Target
+	StrictRouting bool
+	// Template that turns the MPS instance of a device into its address, nil
+	// to use the instance as is. See ParseDestinationTemplate.
+	DestinationTemplate *template.Template
+	// Addresses of MPS instances by the name stored in the database, nil for
+	// none. Aliases take precedence over DestinationTemplate.
+	Aliases *Aliases
+	// MPS instances that share the requests Target would receive, nil to use
+	// Target alone. Target still provides the default port of instances.
+	Pool *Pool
+	// Health of MPS instances, nil to assume they are all healthy. Unhealthy
+	// default targets and alias addresses are only tried once the healthy
+	// ones have failed. See CheckAliases.
+	Health *HealthChecker
 	// Function for serving incoming connections
 	serve func(ln net.Listener) error
+	// Function for connecting to upstream servers, a net.Dialer when nil
+	dial func(network, address string) (net.Conn, error)
+
+	mu         sync.Mutex
+	listener   net.Listener
+	inShutdown atomic.Bool
+	// Active client connections and their current state
+	conns map[*clientConn]connState
+
+	// upstreamsMu guards upstreams, separately from mu since upstreams are
+	// released while mu is held by closeAllConns
+	upstreamsMu sync.Mutex
+	// Number of open upstream connections by address
+	upstreams map[string]int
+
+	// aliasesMu guards aliasTargets, the alias addresses added to Health
+	aliasesMu    sync.Mutex
+	aliasTargets map[string]bool
 }
 
 // NewServer creates a new proxy server with the given address and target
-func NewServer(db db.Manager, addr, target string) Server {
+func NewServer(db db.Manager, addr, target string) *Server {
 	if addr == "" {
 		addr = ":8003"
 	}
-	server := Server{
-		Addr:   addr,
-		Target: target,
-		DB:     db,
+	server := &Server{
+		Addr:           addr,
+		Target:         target,
+		DB:             db,
+		MaxHeaderBytes: DefaultMaxHeaderBytes,
+		HeaderTimeout:  DefaultHeaderTimeout,
+		DialTimeout:    DefaultDialTimeout,
+		LookupTimeout:  DefaultLookupTimeout,
 	}
 	server.serve = server.serveDefault
 	return server
 }
 
 // ListenAndServe listens on the TCP network address laddr and then handle packets
-// on incoming connections.
-func (s Server) ListenAndServe() error {
+// on incoming connections. After Shutdown it returns ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.inShutdown.Load() {
+		return ErrServerClosed
+	}
 	listener, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	// Shutdown may have run before the listener was recorded
+	if s.inShutdown.Load() {
+		_ = listener.Close()
+		return ErrServerClosed
+	}
 	return s.serve(listener)
 }
 
 // serveDefault is the default serving function that handles incoming connections
-func (s Server) serveDefault(ln net.Listener) error {
+func (s *Server) serveDefault(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println(err)
 			continue
 		}
-		go s.handleConn(conn)
+		c := newClientConn(s, conn)
+		go c.serve()
+	}
+}
+
+// Shutdown gracefully stops the server. It closes the listener and any idle
+// keep-alive connections, then waits for active connections to finish. If ctx
+// expires first, the remaining connections are closed and ctx's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		if err = s.listener.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackConn adds c to or removes it from the set of active connections. It
+// reports false when a connection is added during shutdown, and marks c as
+// overloaded when MaxConns connections are already active.
+func (s *Server) trackConn(c *clientConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.inShutdown.Load() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[*clientConn]connState{}
+	}
+	c.overloaded = s.MaxConns > 0 && len(s.conns) >= s.MaxConns
+	s.conns[c] = stateAccepting
+	return true
+}
+
+// setState records the state of c. It reports false when c would become idle
+// while the server is shutting down, in which case c should close instead.
+func (s *Server) setState(c *clientConn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == stateIdle && s.inShutdown.Load() {
+		return false
+	}
+	if _, ok := s.conns[c]; ok {
+		s.conns[c] = state
+	}
+	return true
+}
+
+// closeIdleConns closes connections that are waiting for a request and reports
+// whether no connections remain
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, state := range s.conns {
+		if state == stateIdle {
+			closeConn(c.conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// closeAllConns closes every active connection along with its upstreams
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.close()
 	}
 }
 
 // parseGuid extracts the GUID from the provided content string (the url)
-func (s Server) parseGuid(content string) string {
+func (s *Server) parseGuid(content string) string {
 	guid := ""
 	splitString := strings.Split(content, "\n")
 	if len(splitString) < 2 {
@@ -81,86 +266,157 @@ func (s Server) parseGuid(content string) string {
 	return guid
 }
 
-// handleConn handles an incoming connection by setting up forward and backward proxies
-func (s Server) handleConn(conn net.Conn) {
-	destChannel := make(chan net.Conn, 1)
-	defer close(destChannel)
-
-	go s.forward(conn, destChannel)
-	dst := <-destChannel
-	go s.backward(conn, dst)
-}
-
-// forward proxies data from the source connection to the destination server
-func (s Server) forward(conn net.Conn, destChannel chan net.Conn) {
-	var dst net.Conn
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("Error closing connection: %v", err)
+// destinations returns the addresses of the MPS instance a request is routed
+// to, in the order they should be tried. The database lookup is abandoned
+// when ctx is done.
+func (s *Server) destinations(ctx context.Context, head []byte) ([]string, error) {
+	guid := s.parseGuid(string(head))
+	if guid == "" {
+		return s.defaultTargets(), nil
+	}
+	// call to database to get the mps instance
+	instance, err := s.lookup(ctx, guid)
+	if err != nil {
+		return nil, err
+	}
+	if instance == "" {
+		if s.StrictRouting {
+			log.Printf("Rejecting request for device %s: no MPS instance found in strict routing mode", guid)
+			return nil, errUnknownDevice
 		}
-	}()
+		return s.defaultTargets(), nil
+	}
 
-	var once sync.Once
-	buff := make([]byte, 65535)
-	for {
-		n, err := conn.Read(buff)
+	instances := s.Aliases.Lookup(instance)
+	if instances == nil {
+		if instance, err = s.renderDestination(instance, guid); err != nil {
+			log.Printf("Cannot route request for device %s: destination template: %v", guid, err)
+			return nil, errInvalidInstance
+		}
+		instances = []string{instance}
+	}
+	addrs := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		addr, err := instanceAddress(instance, s.Target)
 		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-			}
-			return
+			log.Printf("Cannot route request for device %s: %v", guid, err)
+			return nil, errInvalidInstance
 		}
-		b := buff[:n]
-
-		once.Do(func() {
-			destination := s.Target
-			guid := s.parseGuid(string(b))
-			if guid != "" {
-				// call to database to get the mps instance
-				instance := s.DB.Query(guid)
-				if instance != "" {
-					parts := strings.Split(destination, ":")
-					parts[0] = instance
-					destination = parts[0] + ":" + parts[1]
-				}
-			}
-			// connects to target server
-			dst, err = net.Dial("tcp", destination)
-			if err != nil {
-				log.Println(err.Error())
-				return
-			}
-			destChannel <- dst
-		})
+		addrs = append(addrs, addr)
+	}
+	return s.healthyFirst(addrs), nil
+}
 
-		if dst == nil {
-			return
-		}
-		_, err = io.Copy(dst, bytes.NewReader(b))
-		if err != nil {
-			log.Println(err)
-			if err := dst.Close(); err != nil {
-				log.Printf("Error closing dst: %v", err)
-			}
-			return
+// defaultTargets returns the addresses of requests that are not routed to a
+// specific MPS instance, in the order they should be tried
+func (s *Server) defaultTargets() []string {
+	if s.Pool == nil {
+		return []string{s.Target}
+	}
+	return s.healthyFirst(s.Pool.order(s.activeUpstreams))
+}
+
+// healthyFirst moves the unhealthy addresses of addrs to the end, keeping
+// their order otherwise
+func (s *Server) healthyFirst(addrs []string) []string {
+	if s.Health == nil {
+		return addrs
+	}
+	healthy := make([]string, 0, len(addrs))
+	var unhealthy []string
+	for _, addr := range addrs {
+		if s.Health.Healthy(addr) {
+			healthy = append(healthy, addr)
+		} else {
+			unhealthy = append(unhealthy, addr)
 		}
 	}
+	return append(healthy, unhealthy...)
 }
 
-// backward proxies data from the destination server back to the source connection
-func (s Server) backward(conn, dst net.Conn) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("Error closing conn: %v", err)
+// CheckAliases has Health check the address of every alias, and stop
+// checking those of aliases removed since the last call unless they are
+// default targets. Call it again whenever the aliases are reloaded.
+func (s *Server) CheckAliases() {
+	if s.Health == nil {
+		return
+	}
+	targets := map[string]bool{}
+	for _, instance := range s.Aliases.Instances() {
+		if addr, err := instanceAddress(instance, s.Target); err == nil {
+			targets[addr] = true
 		}
-		if err := dst.Close(); err != nil {
-			log.Printf("Error closing dst: %v", err)
+	}
+	defaults := map[string]bool{s.Target: true}
+	if s.Pool != nil {
+		for _, addr := range s.Pool.Addrs() {
+			defaults[addr] = true
 		}
-	}()
-	_, err := io.Copy(conn, dst)
-	if err != nil {
-		if err != io.EOF {
-			log.Println(err)
+	}
+
+	s.aliasesMu.Lock()
+	defer s.aliasesMu.Unlock()
+	for addr := range s.aliasTargets {
+		if !targets[addr] && !defaults[addr] {
+			s.Health.Remove(addr)
 		}
 	}
+	for addr := range targets {
+		s.Health.Add(addr)
+	}
+	s.aliasTargets = targets
+}
+
+// trackUpstream adds delta to the count of open upstream connections to addr
+func (s *Server) trackUpstream(addr string, delta int) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+	if s.upstreams == nil {
+		s.upstreams = map[string]int{}
+	}
+	s.upstreams[addr] += delta
+	if s.upstreams[addr] <= 0 {
+		delete(s.upstreams, addr)
+	}
+}
+
+// activeUpstreams returns the number of open upstream connections to addr
+func (s *Server) activeUpstreams(addr string) int {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+	return s.upstreams[addr]
+}
+
+// lookup queries the database for the MPS instance of guid, giving up after
+// LookupTimeout or when ctx is done. It returns an empty instance for devices
+// the database does not know.
+func (s *Server) lookup(ctx context.Context, guid string) (string, error) {
+	if s.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.LookupTimeout)
+		defer cancel()
+	}
+	route, err := db.Adapt(s.DB).Lookup(ctx, guid)
+	switch {
+	case err == nil:
+		return route.MPSInstance, nil
+	case errors.Is(err, db.ErrNotFound):
+		return "", nil
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Println("lookup timed out for device", guid)
+		return "", errLookupTimeout
+	case errors.Is(err, context.Canceled):
+		return "", err
+	}
+	log.Printf("lookup failed for device %s: %v", guid, err)
+	return "", errDatabaseUnavailable
+}
+
+// dialUpstream connects to the MPS instance at address
+func (s *Server) dialUpstream(address string) (net.Conn, error) {
+	if s.dial != nil {
+		return s.dial("tcp", address)
+	}
+	dialer := net.Dialer{Timeout: s.DialTimeout}
+	return dialer.Dial("tcp", address)
 }
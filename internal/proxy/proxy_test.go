@@ -5,9 +5,17 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -68,7 +76,8 @@ func TestBackwardNoGUID(t *testing.T) {
 	ready := make(chan bool, 1)
 	go func() {
 		_, _ = destConn.Write([]byte("upstream data"))
-		testServer.backward(serverConn, destConn)
+		c := newClientConn(testServer, serverConn)
+		c.backward(&upstreamConn{conn: destConn, br: bufio.NewReader(destConn)})
 		ready <- true
 	}()
 	<-ready
@@ -86,13 +95,13 @@ func TestBackwardNoGUID(t *testing.T) {
 func TestBackwardEOF(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{}
 	srv := NewServer(mockDB, ":0", "127.0.0.1:0")
-	c := &connTester{}
+	c := newClientConn(srv, &connTester{})
 	pr, pw := net.Pipe()
 	_ = pw.Close()
-	srv.backward(c, pr)
+	c.backward(&upstreamConn{conn: pr, br: bufio.NewReader(pr)})
 }
 
-func TestHandleConnEndToEnd(t *testing.T) {
+func TestServeEndToEnd(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{QueryResult: "127.0.0.1"}
 	lst, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -123,7 +132,7 @@ func TestHandleConnEndToEnd(t *testing.T) {
 	client, app := net.Pipe()
 	defer func() { _ = client.Close() }()
 	defer func() { _ = app.Close() }()
-	go srv.handleConn(app)
+	go newClientConn(srv, app).serve()
 
 	req := "GET /x/63f32fee-238e-4f6a-a091-092270d22439 HTTP/1.1\r\n\r\nhello"
 	_, _ = client.Write([]byte(req))
@@ -145,7 +154,7 @@ func TestHandleConnEndToEnd(t *testing.T) {
 	}
 }
 
-func TestForwardWriteErrorHandling(t *testing.T) {
+func TestServeWriteErrorHandling(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{QueryResult: "127.0.0.1"}
 	ln, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -154,7 +163,6 @@ func TestForwardWriteErrorHandling(t *testing.T) {
 	defer func() { _ = ln.Close() }()
 	_, port, _ := net.SplitHostPort(ln.Addr().String())
 	srv := NewServer(mockDB, ":0", "127.0.0.1:"+port)
-	destChannel := make(chan net.Conn)
 
 	// Accept one connection on the server side
 	go func() {
@@ -163,18 +171,12 @@ func TestForwardWriteErrorHandling(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 		_ = conn.Close()
 	}()
-	// Drain destChannel so forward() doesn't block on sending dst
-	go func() {
-		if dst := <-destChannel; dst != nil {
-			_ = dst.Close()
-		}
-	}()
 
 	clientConn := &connTester{}
 	_, _ = clientConn.Write([]byte("GET /x/63f32fee-238e-4f6a-a091-092270d22439 HTTP/1.1\r\n\r\n"))
 
 	done := make(chan struct{})
-	go func() { srv.forward(clientConn, destChannel); close(done) }()
+	go func() { newClientConn(srv, clientConn).serve(); close(done) }()
 
 	select {
 	case <-done:
@@ -184,7 +186,7 @@ func TestForwardWriteErrorHandling(t *testing.T) {
 	}
 }
 
-func TestForwardWithGUIDUsesDBInstance(t *testing.T) {
+func TestServeWithGUIDUsesDBInstance(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{
 		ConnectResult:     &sql.DB{},
 		ConnectError:      nil,
@@ -203,10 +205,10 @@ func TestForwardWithGUIDUsesDBInstance(t *testing.T) {
 	testServer := NewServer(mockDB, ":0", "mps:"+port)
 	var clientConn net.Conn = &connTester{}
 
-	destChannel := make(chan net.Conn)
 	complete := make(chan string, 1)
 	errCh := make(chan error, 1)
 
+	req := "POST /api/v1/amt/log/audit/63f32fee-238e-4f6a-a091-092270d22439?startIndex=0 HTTP/1.1\r\nHost: example\r\nContent-Length: 4\r\n\r\nbody"
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -214,9 +216,8 @@ func TestForwardWithGUIDUsesDBInstance(t *testing.T) {
 			return
 		}
 		defer func() { _ = conn.Close() }()
-		buf := make([]byte, 65535)
-		<-destChannel
-		n, err := conn.Read(buf)
+		buf := make([]byte, len(req))
+		n, err := io.ReadFull(conn, buf)
 		if err != nil {
 			errCh <- err
 			return
@@ -224,8 +225,7 @@ func TestForwardWithGUIDUsesDBInstance(t *testing.T) {
 		complete <- string(buf[:n])
 	}()
 
-	req := "GET /api/v1/amt/log/audit/63f32fee-238e-4f6a-a091-092270d22439?startIndex=0 HTTP/1.1\r\nHost: example\r\n\r\nbody"
-	go func() { _, _ = clientConn.Write([]byte(req)); testServer.forward(clientConn, destChannel) }()
+	go func() { _, _ = clientConn.Write([]byte(req)); newClientConn(testServer, clientConn).serve() }()
 
 	select {
 	case got := <-complete:
@@ -237,17 +237,16 @@ func TestForwardWithGUIDUsesDBInstance(t *testing.T) {
 	}
 }
 
-func TestForwardDialFailureReturnsGracefully(t *testing.T) {
+func TestServeDialFailureReturnsGracefully(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{QueryResult: "127.0.0.1"}
 	testServer := NewServer(mockDB, ":0", "127.0.0.1:0")
 	var clientConn net.Conn = &connTester{}
-	destChannel := make(chan net.Conn)
 
 	_, _ = clientConn.Write([]byte("GET /x/63f32fee-238e-4f6a-a091-092270d22439 HTTP/1.1\r\n\r\n"))
-	testServer.forward(clientConn, destChannel)
+	newClientConn(testServer, clientConn).serve()
 }
 
-func TestForwardNoGUID_UsesDefaultTarget(t *testing.T) {
+func TestServeNoGUIDUsesDefaultTarget(t *testing.T) {
 	mockDB := &test.MockSQLDBManager{QueryResult: ""}
 	ln, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -257,7 +256,6 @@ func TestForwardNoGUID_UsesDefaultTarget(t *testing.T) {
 	_, port, _ := net.SplitHostPort(ln.Addr().String())
 	srv := NewServer(mockDB, ":0", "127.0.0.1:"+port)
 
-	destChannel := make(chan net.Conn)
 	got := make(chan string, 1)
 	errCh := make(chan error, 1)
 	go func() {
@@ -268,7 +266,6 @@ func TestForwardNoGUID_UsesDefaultTarget(t *testing.T) {
 		}
 		defer func() { _ = conn.Close() }()
 		buf := make([]byte, 65535)
-		<-destChannel
 		n, err := conn.Read(buf)
 		if err != nil {
 			errCh <- err
@@ -279,7 +276,7 @@ func TestForwardNoGUID_UsesDefaultTarget(t *testing.T) {
 
 	clientConn := &connTester{}
 	_, _ = clientConn.Write([]byte("original request"))
-	go srv.forward(clientConn, destChannel)
+	go newClientConn(srv, clientConn).serve()
 
 	select {
 	case s := <-got:
@@ -296,4 +293,521 @@ func TestNewServerDefaultAddr(t *testing.T) {
 	s := NewServer(mockDB, "", "target:1234")
 	assert.Equal(t, ":8003", s.Addr)
 	assert.Equal(t, "target:1234", s.Target)
+	assert.Equal(t, DefaultMaxHeaderBytes, s.MaxHeaderBytes)
+	assert.Equal(t, DefaultHeaderTimeout, s.HeaderTimeout)
+	assert.Equal(t, DefaultDialTimeout, s.DialTimeout)
+}
+
+func TestReadHead(t *testing.T) {
+	req := "GET /api/v1/amt/power/state/63f32fee-238e-4f6a-a091-092270d22439 HTTP/1.1\r\nHost: example\r\n\r\nbody"
+	tests := []struct {
+		name     string
+		readSize int
+		maxBytes int
+		want     string
+		wantErr  error
+	}{
+		{"Single Read", 0, 0, strings.TrimSuffix(req, "body"), nil},
+		{"Byte By Byte", 1, 0, strings.TrimSuffix(req, "body"), nil},
+		{"Size Cap", 1, 16, req[:16], nil},
+		{"Incomplete Head", 0, 0, "GET / HTTP/1.1\r\n", io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{MaxHeaderBytes: tt.maxBytes}
+			content := req
+			if tt.wantErr != nil {
+				content = tt.want
+			}
+			c := newClientConn(srv, &connTester{buffer: []byte(content), readSize: tt.readSize})
+			got, err := c.readRequest()
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestReadHeadTimeout(t *testing.T) {
+	srv := &Server{HeaderTimeout: 50 * time.Millisecond}
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = app.Close() }()
+	go func() { _, _ = client.Write([]byte("GET /x HTTP/1.1\r\n")) }()
+
+	got, err := newClientConn(srv, app).readRequest()
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Equal(t, "GET /x HTTP/1.1\r\n", string(got))
+}
+
+func TestServeSplitHeadUsesDBInstance(t *testing.T) {
+	mockDB := &test.MockSQLDBManager{QueryResult: "127.0.0.1"}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	// the default target does not resolve, so only the DB instance can be reached
+	srv := NewServer(mockDB, ":0", "mps:"+port)
+
+	req := "GET /api/v1/amt/power/state/63f32fee-238e-4f6a-a091-092270d22439 HTTP/1.1\r\nHost: example\r\n\r\n"
+	clientConn := &connTester{buffer: []byte(req), readSize: 1}
+	got := make(chan string, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		b := make([]byte, len(req))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			errCh <- err
+			return
+		}
+		got <- string(b)
+	}()
+	go newClientConn(srv, clientConn).serve()
+
+	select {
+	case s := <-got:
+		assert.Equal(t, req, s)
+	case err := <-errCh:
+		t.Fatalf("server error: %v", err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for forwarded data")
+	}
+}
+
+// dialRecorder resolves upstream hosts to local test servers and records the
+// hosts that were dialed
+type dialRecorder struct {
+	mu     sync.Mutex
+	hosts  map[string]string
+	dialed []string
+}
+
+func (d *dialRecorder) dial(network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.dialed = append(d.dialed, host)
+	target, ok := d.hosts[host]
+	d.mu.Unlock()
+	if !ok {
+		return nil, errors.New("unknown host " + host)
+	}
+	return net.Dial(network, target)
+}
+
+func (d *dialRecorder) hostsDialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+// newNamedUpstream starts an MPS stand-in that answers with its name and the
+// request path, echoing any request body
+func newNamedUpstream(t *testing.T, name string) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name+" "+r.URL.Path)
+		if r.ContentLength != 0 {
+			_, _ = io.WriteString(w, " ")
+			_, _ = io.Copy(w, r.Body)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+// roundTrip writes a raw request to conn and reads the response body
+func roundTrip(t *testing.T, conn net.Conn, br *bufio.Reader, req string) string {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	return string(body)
+}
+
+const (
+	guidA = "63f32fee-238e-4f6a-a091-092270d22439"
+	guidB = "d12428be-9fa1-4226-9784-54b2038beab6"
+)
+
+func newKeepAliveServer(t *testing.T) (*Server, *dialRecorder) {
+	mockDB := &test.MockSQLDBManager{QueryResults: map[string]string{guidA: "mps-a", guidB: "mps-b"}}
+	recorder := &dialRecorder{hosts: map[string]string{
+		"mps":   newNamedUpstream(t, "default"),
+		"mps-a": newNamedUpstream(t, "a"),
+		"mps-b": newNamedUpstream(t, "b"),
+	}}
+	srv := NewServer(mockDB, ":0", "mps:3000")
+	srv.dial = recorder.dial
+	return srv, recorder
+}
+
+func TestServeKeepAliveReroutesEachRequest(t *testing.T) {
+	srv, recorder := newKeepAliveServer(t)
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	br := bufio.NewReader(client)
+
+	assert.Equal(t, "a /api/v1/amt/power/state/"+guidA,
+		roundTrip(t, client, br, "GET /api/v1/amt/power/state/"+guidA+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	assert.Equal(t, "b /api/v1/amt/power/state/"+guidB,
+		roundTrip(t, client, br, "GET /api/v1/amt/power/state/"+guidB+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	assert.Equal(t, "a /api/v1/amt/features/"+guidA,
+		roundTrip(t, client, br, "GET /api/v1/amt/features/"+guidA+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	assert.Equal(t, "default /api/v1/devices",
+		roundTrip(t, client, br, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n"))
+
+	// upstream connections are reused per MPS instance
+	assert.Equal(t, []string{"mps-a", "mps-b", "mps"}, recorder.hostsDialed())
+}
+
+func TestServeKeepAliveRequestBodies(t *testing.T) {
+	srv, _ := newKeepAliveServer(t)
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	br := bufio.NewReader(client)
+
+	assert.Equal(t, "a /api/v1/amt/power/action/"+guidA+" {\"action\":2}",
+		roundTrip(t, client, br, "POST /api/v1/amt/power/action/"+guidA+" HTTP/1.1\r\nHost: mps\r\nContent-Length: 12\r\n\r\n{\"action\":2}"))
+	assert.Equal(t, "b /api/v1/amt/power/action/"+guidB+" {\"action\":8}",
+		roundTrip(t, client, br, "POST /api/v1/amt/power/action/"+guidB+" HTTP/1.1\r\nHost: mps\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n{\"act\r\n7\r\nion\":8}\r\n0\r\n\r\n"))
+	assert.Equal(t, "default /api/v1/devices",
+		roundTrip(t, client, br, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n"))
+}
+
+func TestServeKeepAliveRedialsStaleUpstream(t *testing.T) {
+	srv, recorder := newKeepAliveServer(t)
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	c := newClientConn(srv, app)
+	go c.serve()
+	br := bufio.NewReader(client)
+
+	req := "GET /api/v1/amt/power/state/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n"
+	assert.Equal(t, "a /api/v1/amt/power/state/"+guidA, roundTrip(t, client, br, req))
+	// simulate the upstream closing its idle side of the connection
+	_ = c.upstreams["mps-a:3000"].conn.(*net.TCPConn).CloseRead()
+	assert.Equal(t, "a /api/v1/amt/power/state/"+guidA, roundTrip(t, client, br, req))
+	assert.Equal(t, []string{"mps-a", "mps-a"}, recorder.hostsDialed())
+}
+
+func TestServeKeepAliveRedialsClosedUpstreamForBody(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "a "+r.URL.Path)
+		if r.ContentLength != 0 {
+			_, _ = io.WriteString(w, " ")
+			_, _ = io.Copy(w, r.Body)
+		}
+	}))
+	ts.Config.IdleTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+	mockDB := &test.MockSQLDBManager{QueryResults: map[string]string{guidA: "mps-a"}}
+	recorder := &dialRecorder{hosts: map[string]string{"mps-a": ts.Listener.Addr().String()}}
+	srv := NewServer(mockDB, ":0", "mps:3000")
+	srv.dial = recorder.dial
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	br := bufio.NewReader(client)
+
+	assert.Equal(t, "a /api/v1/amt/power/state/"+guidA,
+		roundTrip(t, client, br, "GET /api/v1/amt/power/state/"+guidA+" HTTP/1.1\r\nHost: mps\r\n\r\n"))
+	// the upstream closes its idle connection, as MPS does after its
+	// keep-alive timeout, and the request with a body goes to a new one
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, "a /api/v1/amt/power/action/"+guidA+" on",
+		roundTrip(t, client, br, "POST /api/v1/amt/power/action/"+guidA+" HTTP/1.1\r\nHost: mps\r\nContent-Length: 2\r\n\r\non"))
+	assert.Equal(t, []string{"mps-a", "mps-a"}, recorder.hostsDialed())
+}
+
+func TestServeConnectTunnel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		_, _ = io.Copy(conn, br)
+	}()
+
+	recorder := &dialRecorder{hosts: map[string]string{"mps": ln.Addr().String()}}
+	srv := NewServer(&test.MockSQLDBManager{}, ":0", "mps:3000")
+	srv.dial = recorder.dial
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	br := bufio.NewReader(client)
+
+	_, _ = io.WriteString(client, "CONNECT mps:16994 HTTP/1.1\r\nHost: mps:16994\r\n\r\n")
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// bytes flow both ways once the tunnel is established
+	_, _ = io.WriteString(client, "ping")
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(br, echoed)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
+
+func TestServeWebSocketUpgradePinsUpstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		// echo frames back once upgraded
+		_, _ = io.Copy(conn, br)
+	}()
+
+	mockDB := &test.MockSQLDBManager{QueryResults: map[string]string{guidA: "mps-a"}}
+	recorder := &dialRecorder{hosts: map[string]string{"mps-a": ln.Addr().String()}}
+	srv := NewServer(mockDB, ":0", "mps:3000")
+	srv.dial = recorder.dial
+
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go newClientConn(srv, app).serve()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	br := bufio.NewReader(client)
+
+	_, _ = io.WriteString(client, "GET /relay/webrelay.ashx?p=2&host="+guidA+"&port=16994 HTTP/1.1\r\nHost: mps\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// bytes that look like a request for another device stay on the pinned upstream
+	frame := "GET /api/v1/amt/power/state/" + guidB + " HTTP/1.1\r\n\r\n"
+	_, _ = io.WriteString(client, frame)
+	echoed := make([]byte, len(frame))
+	_, err = io.ReadFull(br, echoed)
+	assert.NoError(t, err)
+	assert.Equal(t, frame, string(echoed))
+	assert.Equal(t, []string{"mps-a"}, recorder.hostsDialed())
+}
+
+func TestServeCloseDelimitedResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			_, _ = io.WriteString(conn, "HTTP/1.0 200 OK\r\n\r\nuntil close")
+		}
+		_ = conn.Close()
+	}()
+
+	srv := NewServer(&test.MockSQLDBManager{}, ":0", ln.Addr().String())
+	client, app := net.Pipe()
+	defer func() { _ = client.Close() }()
+	done := make(chan struct{})
+	go func() { newClientConn(srv, app).serve(); close(done) }()
+
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.WriteString(client, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+	got, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n\r\nuntil close", string(got))
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for connection to close")
+	}
+}
+
+// startServer runs srv on a local port and returns its address along with a
+// channel receiving the result of ListenAndServe
+func startServer(t *testing.T, srv *Server) (string, chan error) {
+	srv.Addr = "127.0.0.1:0"
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		ln := srv.listener
+		srv.mu.Unlock()
+		if ln != nil {
+			return ln.Addr().String(), served
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for server to listen")
+	return "", nil
+}
+
+// newHeldUpstream starts an MPS stand-in that signals arrived for each request
+// and only answers once release is closed
+func newHeldUpstream(t *testing.T, arrived, release chan struct{}) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		_, _ = io.WriteString(w, "released")
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestShutdownDrainsActiveConnections(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	srv := NewServer(&test.MockSQLDBManager{}, "", newHeldUpstream(t, arrived, release))
+	addr, served := startServer(t, srv)
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	_, _ = io.WriteString(client, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+
+	// wait until the request is in flight
+	<-arrived
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrServerClosed, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for ListenAndServe to return")
+	}
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "listener should be closed")
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the active connection finished")
+	case <-time.After(2 * shutdownPollInterval):
+	}
+
+	close(release)
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "released", string(body))
+
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for shutdown to drain")
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", newNamedUpstream(t, "default"))
+	addr, _ := startServer(t, srv)
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	br := bufio.NewReader(client)
+	assert.Equal(t, "default /api/v1/devices",
+		roundTrip(t, client, br, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx))
+
+	// the idle keep-alive connection has been closed
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestShutdownTimeoutClosesConnections(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv := NewServer(&test.MockSQLDBManager{}, "", newHeldUpstream(t, arrived, release))
+	addr, _ := startServer(t, srv)
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	_, _ = io.WriteString(client, "GET /api/v1/devices HTTP/1.1\r\nHost: mps\r\n\r\n")
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenAndServeAfterShutdown(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "127.0.0.1:0", "mps:3000")
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, srv.ListenAndServe())
+}
+
+func TestServeDefaultExitsOnClosedListener(t *testing.T) {
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	_ = ln.Close()
+	assert.ErrorIs(t, srv.serveDefault(ln), net.ErrClosed)
 }
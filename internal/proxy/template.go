@@ -0,0 +1,57 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// DestinationData holds the fields available to a destination template, for
+// example "{{.Instance}}.mps-headless.default.svc.cluster.local:{{.DefaultPort}}"
+type DestinationData struct {
+	// MPS instance stored in the database for the device
+	Instance string
+	// GUID of the device
+	GUID string
+	// Host of the default target
+	DefaultHost string
+	// Port of the default target
+	DefaultPort string
+}
+
+// ParseDestinationTemplate parses a destination template and checks that it
+// only refers to fields of DestinationData
+func ParseDestinationTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("destination").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// unknown fields are only reported when the template is executed
+	if err := tmpl.Execute(io.Discard, DestinationData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderDestination applies the server's destination template to the instance
+// stored for guid. The result is interpreted like an instance, so it may leave
+// out the port.
+func (s *Server) renderDestination(instance, guid string) (string, error) {
+	if s.DestinationTemplate == nil {
+		return instance, nil
+	}
+	data := DestinationData{Instance: instance, GUID: guid, DefaultHost: s.Target}
+	if host, port, err := net.SplitHostPort(s.Target); err == nil {
+		data.DefaultHost, data.DefaultPort = host, port
+	}
+	var b strings.Builder
+	if err := s.DestinationTemplate.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,78 @@
+/*********************************************************************
+ * Copyright (c) Intel Corporation 2021
+ * SPDX-License-Identifier: Apache-2.0
+ **********************************************************************/
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/device-management-toolkit/mps-router/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDestinationTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{"All Fields", "{{.Instance}}-{{.GUID}}.{{.DefaultHost}}:{{.DefaultPort}}", false},
+		{"Functions", `{{printf "%s.mps-headless" .Instance}}`, false},
+		{"Syntax Error", "{{.Instance", true},
+		{"Unknown Field", "{{.Instance}}.{{.Namespace}}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDestinationTemplate(tt.text)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDestinationTemplate(t *testing.T) {
+	head := []byte("GET /api/v1/amt/log/audit/" + guidA + " HTTP/1.1\r\nHost: mps\r\n\r\n")
+	tests := []struct {
+		name     string
+		text     string
+		instance string
+		target   string
+		want     string
+	}{
+		{"Headless Service", "{{.Instance}}.mps-headless.default.svc.cluster.local:{{.DefaultPort}}", "mps-0", "mps:3000", "mps-0.mps-headless.default.svc.cluster.local:3000"},
+		{"Port From Target", "{{.Instance}}.mps-headless", "mps-1", "mps:3000", "mps-1.mps-headless:3000"},
+		{"Default Host", "{{.Instance}}.{{.DefaultHost}}", "mps-2", "mps.svc:4433", "mps-2.mps.svc:4433"},
+		{"GUID", "{{.GUID}}.devices:{{.DefaultPort}}", "mps-0", "mps:3000", guidA + ".devices:3000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseDestinationTemplate(tt.text)
+			assert.NoError(t, err)
+			srv := NewServer(&test.MockSQLDBManager{QueryResult: tt.instance}, "", tt.target)
+			srv.DestinationTemplate = tmpl
+			got, err := srv.destinations(context.Background(), head)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{tt.want}, got)
+		})
+	}
+}
+
+func TestDestinationTemplateSkippedWithoutInstance(t *testing.T) {
+	tmpl, err := ParseDestinationTemplate("{{.Instance}}.mps-headless:{{.DefaultPort}}")
+	assert.NoError(t, err)
+	srv := NewServer(&test.MockSQLDBManager{}, "", "mps:3000")
+	srv.DestinationTemplate = tmpl
+
+	// unknown devices and requests without a GUID keep going to the default target
+	got, err := srv.destinations(context.Background(), []byte("GET /api/v1/amt/log/audit/"+guidA+" HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mps:3000"}, got)
+	got, err = srv.destinations(context.Background(), []byte("GET /api/v1/devices HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mps:3000"}, got)
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/device-management-toolkit/mps-router/internal/db"
@@ -15,6 +16,8 @@ type MockSQLDBManager struct {
 	MPSInstanceError  error
 	HealthResult      bool
 	QueryResult       string
+	// QueryResults overrides QueryResult per GUID when set
+	QueryResults map[string]string
 }
 
 func (mock *MockSQLDBManager) Connect() (db.Database, error) {
@@ -28,11 +31,14 @@ func (mock *MockSQLDBManager) GetMPSInstance(db db.Database, guid string) (strin
 	return mock.MPSInstanceResult, nil
 }
 
-func (mock *MockSQLDBManager) Health() bool {
-	return mock.HealthResult
+func (mock *MockSQLDBManager) Health(ctx context.Context) db.HealthReport {
+	return db.HealthReport{Backend: "mock", Reachable: mock.HealthResult}
 }
 
 func (mock *MockSQLDBManager) Query(guid string) string {
+	if mock.QueryResults != nil {
+		return mock.QueryResults[guid]
+	}
 	return mock.QueryResult
 }
 
@@ -44,6 +50,13 @@ type MockNOSQLDBManager struct {
 	MPSInstanceError  error
 	HealthResult      bool
 	QueryResult       string
+	// Closed is set once Close is called
+	Closed bool
+}
+
+func (mock *MockNOSQLDBManager) Close() error {
+	mock.Closed = true
+	return nil
 }
 
 func (mock *MockNOSQLDBManager) Connect() (db.Database, error) {
@@ -57,8 +70,8 @@ func (mock *MockNOSQLDBManager) GetMPSInstance(db db.Database, guid string) (str
 	return mock.MPSInstanceResult, nil
 }
 
-func (mock *MockNOSQLDBManager) Health() bool {
-	return mock.HealthResult
+func (mock *MockNOSQLDBManager) Health(ctx context.Context) db.HealthReport {
+	return db.HealthReport{Backend: "mock", Reachable: mock.HealthResult}
 }
 
 func (mock *MockNOSQLDBManager) Query(guid string) string {